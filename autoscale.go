@@ -0,0 +1,214 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// An AutoscalePolicy determines how a pool is grown and shrunk by
+// (*Pool).Autoscale. The pool is evaluated periodically: it is grown
+// when its machines are saturated or when there is more pending work
+// than the pool's busy machines can absorb; it is shrunk by stopping
+// idle machines when there is no such demand.
+type AutoscalePolicy struct {
+	// Min and Max are the minimum and maximum sizes of the pool.
+	Min, Max int
+
+	// Period is the interval at which the pool is evaluated.
+	// It defaults to 30 seconds.
+	Period time.Duration
+
+	// Pending, if provided, returns the amount of work that is
+	// pending (e.g., the depth of a task queue) at the time of
+	// evaluation.
+	Pending func() int
+
+	// PendingPerMachine is the amount of pending work that a single
+	// new machine is expected to absorb. It defaults to 1.
+	PendingPerMachine int
+
+	// HighLoad is the per-processor 1-minute load average above
+	// which a machine is considered saturated. It defaults to 0.9.
+	HighLoad float64
+
+	// LowLoad is the per-processor 1-minute load average below which
+	// a machine is considered idle. It defaults to 0.1.
+	LowLoad float64
+
+	// HighMemory is the percentage of system memory in use above
+	// which a machine is considered saturated. It defaults to 90.
+	HighMemory float64
+}
+
+func (a *AutoscalePolicy) init() {
+	if a.Period == 0 {
+		a.Period = 30 * time.Second
+	}
+	if a.PendingPerMachine <= 0 {
+		a.PendingPerMachine = 1
+	}
+	if a.HighLoad == 0 {
+		a.HighLoad = 0.9
+	}
+	if a.LowLoad == 0 {
+		a.LowLoad = 0.1
+	}
+	if a.HighMemory == 0 {
+		a.HighMemory = 90
+	}
+	if a.Max < a.Min {
+		a.Max = a.Min
+	}
+}
+
+// MachineLoad is a load sample of a single machine.
+type machineLoad struct {
+	m *Machine
+	// Load is the machine's 1-minute load average per processor.
+	load float64
+	// Mem is the percentage of the machine's memory in use.
+	mem float64
+}
+
+// Decide computes the new target size of a pool of the provided size,
+// given load samples of the pool's running machines and the amount
+// of pending work. The target is always within the policy's bounds.
+// If the pool should be shrunk, decide also returns the idle machines
+// that should be removed from it; these are chosen least loaded
+// first. There may be fewer idle machines than the pool exceeds its
+// target by (e.g., because the policy's maximum was lowered): the
+// remainder must be shrunk regardless of load. Machines without a
+// load sample (e.g., because they are still starting) are considered
+// busy.
+func (a *AutoscalePolicy) decide(size int, loads []machineLoad, pending int) (target int, remove []*Machine) {
+	var (
+		idle      []machineLoad
+		saturated bool
+	)
+	for _, l := range loads {
+		switch {
+		case l.load >= a.HighLoad || l.mem >= a.HighMemory:
+			saturated = true
+		case l.load < a.LowLoad:
+			idle = append(idle, l)
+		}
+	}
+	busy := size - len(idle)
+	if busy < 0 {
+		busy = 0
+	}
+	target = busy + (pending+a.PendingPerMachine-1)/a.PendingPerMachine
+	if saturated && target <= size {
+		target = size + 1
+	}
+	if target < a.Min {
+		target = a.Min
+	}
+	if target > a.Max {
+		target = a.Max
+	}
+	if target >= size {
+		return target, nil
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].load < idle[j].load })
+	n := size - target
+	if n > len(idle) {
+		n = len(idle)
+	}
+	remove = make([]*Machine, n)
+	for i := range remove {
+		remove[i] = idle[i].m
+	}
+	return target, remove
+}
+
+// Autoscale grows and shrinks pool p according to the provided
+// policy until the context is canceled. New machines are started
+// with the pool's parameters; idle machines are removed from the
+// pool and stopped. Autoscale returns the context's error.
+func (p *Pool) Autoscale(ctx context.Context, policy AutoscalePolicy) error {
+	policy.init()
+	tick := time.NewTicker(policy.Period)
+	defer tick.Stop()
+	for {
+		loads := sampleLoads(ctx, p.Machines())
+		var pending int
+		if policy.Pending != nil {
+			pending = policy.Pending()
+		}
+		size := p.Size()
+		target, remove := policy.decide(size, loads, pending)
+		switch {
+		case target > size:
+			log.Printf("autoscale: growing pool from %d to %d machines (pending=%d)", size, target, pending)
+			p.Resize(target)
+		case target < size:
+			log.Printf("autoscale: shrinking pool from %d to %d machines (%d idle)", size, target, len(remove))
+			for _, m := range remove {
+				p.Remove(m)
+			}
+			// Idle machines are preferred, but the pool must still
+			// shrink to the policy's maximum when there are too few
+			// of them.
+			if len(remove) < size-target {
+				p.Resize(target)
+			}
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sampleLoads retrieves the load and memory usage of the provided
+// machines. Machines whose information could not be retrieved are
+// omitted.
+func sampleLoads(ctx context.Context, machines []*Machine) []machineLoad {
+	var (
+		mu    sync.Mutex
+		loads = make([]machineLoad, 0, len(machines))
+	)
+	g, ctx := errgroup.WithContext(ctx)
+	for _, m := range machines {
+		m := m
+		g.Go(func() error {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			load, err := m.LoadInfo(ctx)
+			if err != nil {
+				log.Error.Printf("autoscale: %s: load info: %v", m.Addr, err)
+				return nil
+			}
+			mem, err := m.MemInfo(ctx, false)
+			if err != nil {
+				log.Error.Printf("autoscale: %s: memory info: %v", m.Addr, err)
+				return nil
+			}
+			procs := m.Maxprocs
+			if procs <= 0 {
+				procs = 1
+			}
+			mu.Lock()
+			loads = append(loads, machineLoad{
+				m:    m,
+				load: load.Averages.Load1 / float64(procs),
+				mem:  mem.System.UsedPercent,
+			})
+			mu.Unlock()
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return loads
+}
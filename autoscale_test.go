@@ -0,0 +1,59 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import "testing"
+
+func TestAutoscaleDecide(t *testing.T) {
+	var (
+		m1 = &Machine{Addr: "m1"}
+		m2 = &Machine{Addr: "m2"}
+		m3 = &Machine{Addr: "m3"}
+	)
+	policy := AutoscalePolicy{Min: 1, Max: 4}
+	policy.init()
+	for _, c := range []struct {
+		size    int
+		loads   []machineLoad
+		pending int
+		target  int
+		remove  []*Machine
+	}{
+		// Steady state: busy machines and no pending work.
+		{2, []machineLoad{{m1, 0.5, 10}, {m2, 0.5, 10}}, 0, 2, nil},
+		// Saturated machines grow the pool by one.
+		{2, []machineLoad{{m1, 1.5, 10}, {m2, 0.5, 10}}, 0, 3, nil},
+		{2, []machineLoad{{m1, 0.5, 95}, {m2, 0.5, 10}}, 0, 3, nil},
+		// Pending work grows the pool, up to its maximum.
+		{2, []machineLoad{{m1, 0.5, 10}, {m2, 0.5, 10}}, 1, 3, nil},
+		{2, []machineLoad{{m1, 0.5, 10}, {m2, 0.5, 10}}, 10, 4, nil},
+		// New idle machines are kept while there is pending work.
+		{3, []machineLoad{{m1, 0.5, 10}, {m2, 0.5, 10}, {m3, 0, 10}}, 1, 3, nil},
+		// Idle machines are removed, least loaded first.
+		{3, []machineLoad{{m1, 0.05, 10}, {m2, 0.5, 10}, {m3, 0, 10}}, 0, 1, []*Machine{m3, m1}},
+		// ... but never below the minimum.
+		{2, []machineLoad{{m1, 0.05, 10}, {m3, 0, 10}}, 0, 1, []*Machine{m3}},
+		// Machines without samples are considered busy.
+		{3, []machineLoad{{m3, 0, 10}}, 0, 2, []*Machine{m3}},
+		// Pools above the maximum are shrunk even when their machines
+		// are busy, preferring idle machines.
+		{6, []machineLoad{{m1, 0.5, 10}, {m2, 0.5, 10}}, 0, 4, nil},
+		{6, []machineLoad{{m1, 0.5, 10}, {m2, 0.5, 10}, {m3, 0, 10}}, 0, 4, []*Machine{m3}},
+	} {
+		target, remove := policy.decide(c.size, c.loads, c.pending)
+		if got, want := target, c.target; got != want {
+			t.Errorf("%+v: got %v, want %v", c, got, want)
+		}
+		if got, want := len(remove), len(c.remove); got != want {
+			t.Errorf("%+v: got %v, want %v", c, got, want)
+			continue
+		}
+		for i := range remove {
+			if got, want := remove[i], c.remove[i]; got != want {
+				t.Errorf("%+v: got %v, want %v", c, got.Addr, want.Addr)
+			}
+		}
+	}
+}
@@ -21,9 +21,11 @@ import (
 	"os"
 	"sync"
 
+	"github.com/grailbio/base/data"
 	"github.com/grailbio/base/diagnostic/dump"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/must"
 	"github.com/grailbio/bigmachine/rpc"
 	"golang.org/x/sync/errgroup"
 )
@@ -34,7 +36,12 @@ const RpcPrefix = "/bigrpc/"
 // B is a bigmachine instance. Bs are created by Start and, outside
 // of testing situations, there is exactly one per process.
 type B struct {
+	// system is the B's primary system. Machines are started on it
+	// unless otherwise specified by an OnSystem parameter.
 	system System
+	// systems contains all of the B's systems, including the
+	// primary, keyed by name.
+	systems map[string]System
 	// index is a process-unique identifier for this B. It is useful for
 	// distinguishing logs or diagnostic information.
 	index int32
@@ -45,11 +52,42 @@ type B struct {
 
 	server *rpc.Server
 	client *rpc.Client
+	// clients contains an RPC client for each of the B's initialized
+	// systems, keyed by name.
+	clients map[string]*rpc.Client
+
+	// binaries coordinates the distribution of binaries to the
+	// machines started by this B.
+	binaries *binarySources
 
 	mu       sync.Mutex
 	machines map[string]*Machine
 	driver   bool
 	running  bool
+
+	eventMu     sync.Mutex
+	subscribers map[*eventSubscriber]bool
+
+	// sessionPath is the path of the B's session file, if any.
+	// SessionMu serializes writes to the file.
+	sessionPath string
+	sessionMu   sync.Mutex
+	// restored contains the machines recorded in the session file
+	// when the B was started, to which the B reattaches.
+	restored []sessionMachine
+
+	// diagnostics configures the capture of diagnostics from
+	// unhealthy machines.
+	diagnostics DiagnosticsConfig
+
+	// codecs contains the RPC codecs set by the Codec option, keyed
+	// by method or service name.
+	codecs map[string]rpc.Codec
+	// encodings contains the RPC content encodings set by the
+	// Compression option, keyed by method or service name.
+	encodings map[string]string
+	// rpcSessions is set if the B's RPC clients are in session mode.
+	rpcSessions bool
 }
 
 // Option is an option that can be provided when starting a new B. It is a
@@ -63,9 +101,87 @@ func Name(name string) Option {
 	}
 }
 
+// Systems is an option that registers additional systems with the
+// B, so that a single session may span several of them. Machines are
+// started on an additional system by passing an OnSystem parameter
+// to (*B).Start. Each system must have a distinct name.
+func Systems(systems ...System) Option {
+	return func(b *B) {
+		for _, system := range systems {
+			name := system.Name()
+			must.Nil(b.systems[name], "system ", name, " already registered")
+			b.systems[name] = system
+		}
+	}
+}
+
+// Codec is an option that sets the codec used by the B's RPC
+// clients for calls to the provided method, or for all of the
+// methods of the provided service. See (*rpc.Client).SetCodec.
+func Codec(serviceMethod string, codec rpc.Codec) Option {
+	return func(b *B) {
+		if b.codecs == nil {
+			b.codecs = make(map[string]rpc.Codec)
+		}
+		b.codecs[serviceMethod] = codec
+	}
+}
+
+// Compression is an option that compresses the calls made by the
+// B's RPC clients to the provided method, or to all of the methods
+// of the provided service, with the provided content encoding
+// (rpc.Gzip or rpc.Deflate). See (*rpc.Client).SetCompression.
+func Compression(serviceMethod, encoding string) Option {
+	return func(b *B) {
+		if b.encodings == nil {
+			b.encodings = make(map[string]string)
+		}
+		b.encodings[serviceMethod] = encoding
+	}
+}
+
+// RpcSessions is an option that puts the B's RPC clients in session
+// mode, so that calls to each machine are multiplexed over a single
+// long-lived stream. See (*rpc.Client).EnableSessions.
+func RpcSessions() Option {
+	return func(b *B) {
+		b.rpcSessions = true
+	}
+}
+
 // nextBIndex is the index of the next B that is started.
 var nextBIndex int32
 
+var (
+	runningMu sync.Mutex
+	// running contains the Bs in this process that have been
+	// started and not yet shut down.
+	running = make(map[*B]bool)
+)
+
+// lookupB returns the B through which a machine decoded from a gob
+// stream with the provided address is dialed: a running B that
+// already tracks a machine with the address, or else the most
+// recently started running B. LookupB returns nil if no B is
+// running.
+func lookupB(addr string) *B {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	var latest *B
+	for b := range running {
+		b.mu.Lock()
+		tracked := b.machines[addr] != nil
+		b.mu.Unlock()
+		if tracked {
+			return b
+		}
+		if latest == nil || b.index > latest.index {
+			latest = b
+		}
+	}
+	return latest
+}
+
 // Start is the main entry point of bigmachine. Start starts a new B
 // using the provided system, returning the instance. B's shutdown
 // method should be called to tear down the session, usually in a
@@ -80,14 +196,24 @@ var nextBIndex int32
 //	}
 func Start(system System, opts ...Option) *B {
 	b := &B{
-		index:    atomic.AddInt32(&nextBIndex, 1) - 1,
-		system:   system,
-		machines: make(map[string]*Machine),
+		index:       atomic.AddInt32(&nextBIndex, 1) - 1,
+		system:      system,
+		systems:     map[string]System{system.Name(): system},
+		clients:     make(map[string]*rpc.Client),
+		binaries:    newBinarySources(),
+		machines:    make(map[string]*Machine),
+		subscribers: make(map[*eventSubscriber]bool),
 	}
 	for _, opt := range opts {
 		opt(b)
 	}
+	runningMu.Lock()
+	running[b] = true
+	runningMu.Unlock()
 	b.run()
+	if b.driver && b.sessionPath != "" {
+		b.reattach()
+	}
 	// Test systems run in a single process space and thus
 	// expvar would panic with duplicate key errors.
 	//
@@ -111,9 +237,34 @@ func Start(system System, opts ...Option) *B {
 	return b
 }
 
-// System returns this B's System implementation.
+// System returns this B's primary System implementation.
 func (b *B) System() System { return b.system }
 
+// Systems returns all of the systems registered with this B,
+// including its primary system, ordered by name.
+func (b *B) Systems() []System {
+	systems := make([]System, 0, len(b.systems))
+	for _, system := range b.systems {
+		systems = append(systems, system)
+	}
+	sort.Slice(systems, func(i, j int) bool {
+		return systems[i].Name() < systems[j].Name()
+	})
+	return systems
+}
+
+// systemClient returns the RPC client used to communicate with
+// machines of the provided system. Systems that have not been
+// initialized by this process use the primary system's client.
+func (b *B) systemClient(system System) *rpc.Client {
+	if system != nil {
+		if client := b.clients[system.Name()]; client != nil {
+			return client
+		}
+	}
+	return b.client
+}
+
 // IsDriver is true if this is a driver instance (rather than a spawned machine).
 func (b *B) IsDriver() bool { return b.driver }
 
@@ -129,17 +280,51 @@ func (b *B) run() {
 	case "":
 		b.driver = true
 	case "machine":
+		// A machine runs on the system that started it, which
+		// need not be the primary one.
+		if system, ok := b.systems[os.Getenv("BIGMACHINE_SYSTEM")]; ok {
+			b.system = system
+		}
 	default:
 		log.Fatalf("invalid bigmachine mode %s", mode)
 	}
-	if err := b.system.Init(b); err != nil {
-		log.Fatal(err)
+	// Drivers initialize all of their systems; machines only the
+	// one on which they run.
+	systems := []System{b.system}
+	if b.driver {
+		systems = b.Systems()
 	}
-	var err error
-	b.client, err = rpc.NewClient(func() *http.Client { return b.system.HTTPClient() }, RpcPrefix)
-	if err != nil {
-		log.Fatal(err)
+	for _, system := range systems {
+		if err := system.Init(b); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Systems' sessions are restored before their clients are
+	// created, so that the clients use the restored state (e.g.,
+	// authorities).
+	if b.driver && b.sessionPath != "" {
+		if err := b.restoreSession(); err != nil {
+			log.Error.Printf("session %s: %v", b.sessionPath, err)
+		}
 	}
+	for _, system := range systems {
+		system := system
+		client, err := rpc.NewClient(func() *http.Client { return system.HTTPClient() }, RpcPrefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for serviceMethod, codec := range b.codecs {
+			client.SetCodec(serviceMethod, codec)
+		}
+		for serviceMethod, encoding := range b.encodings {
+			client.SetCompression(serviceMethod, encoding)
+		}
+		if b.rpcSessions {
+			client.EnableSessions()
+		}
+		b.clients[system.Name()] = client
+	}
+	b.client = b.clients[b.system.Name()]
 	b.mu.Lock()
 	b.running = true
 	b.mu.Unlock()
@@ -153,7 +338,7 @@ func (b *B) run() {
 		log.Fatal(err)
 	}
 	mux := http.NewServeMux()
-	mux.Handle(RpcPrefix, b.server)
+	mux.Handle("/", supervisor.Handler())
 	go func() {
 		log.Fatal(b.system.ListenAndServe("", mux))
 	}()
@@ -161,19 +346,47 @@ func (b *B) run() {
 	panic("not reached")
 }
 
-// Dial connects to the machine named by the provided address.
+// Dial connects to the machine named by the provided address. If
+// the address contains an instance cookie (as do the addresses of
+// machines returned by Start), Dial first checks that the machine
+// serving the address is the named instance, failing with
+// ErrInstanceMismatch if it is not.
 //
 // The returned machine is not owned: it is not kept alive as Start
 // does.
 func (b *B) Dial(ctx context.Context, addr string) (*Machine, error) {
+	return b.dial(ctx, addr, b.system)
+}
+
+// dial returns the machine tracked by b at the provided address,
+// dialing it through the provided system if it is not yet tracked.
+func (b *B) dial(ctx context.Context, addr string, system System) (*Machine, error) {
 	// TODO(marius): normalize addrs?
-	// TODO(marius): We should also embed some sort of cookie/capability
-	// into the address so we can distinguish between different
-	// instances of a machine on the same address.
+	b.mu.Lock()
+	m := b.machines[addr]
+	b.mu.Unlock()
+	if m != nil {
+		return m, nil
+	}
+	if instanceOf(addr) != "" {
+		err := b.systemClient(system).Call(ctx, addr, "Supervisor.Ping", 0, nil)
+		if err != nil && isInstanceMismatch(err) {
+			return nil, ErrInstanceMismatch
+		}
+	}
+	return b.track(addr, system), nil
+}
+
+// track returns the machine tracked by b at the provided address,
+// starting a non-owned machine on the provided system if none is
+// tracked. Unlike dial, track does not check the machine's instance
+// before it is started: an instance mismatch fails the machine once
+// it is detected by the machine's calls.
+func (b *B) track(addr string, system System) *Machine {
 	b.mu.Lock()
 	m := b.machines[addr]
 	if m == nil {
-		m = &Machine{Addr: addr, owner: false}
+		m = &Machine{Addr: addr, owner: false, system: system}
 		b.machines[addr] = m
 		m.start(b)
 		go func() {
@@ -185,7 +398,7 @@ func (b *B) Dial(ctx context.Context, addr string) (*Machine, error) {
 		}()
 	}
 	b.mu.Unlock()
-	return m, nil
+	return m
 }
 
 // A Param is a machine parameter. Parameters customize machines
@@ -217,6 +430,77 @@ func (e Environ) applyParam(m *Machine) {
 	m.environ = append(m.environ, e...)
 }
 
+// Resources is a machine parameter that specifies the minimum
+// resources that must be provided by each started machine. Systems
+// that implement ResourceSystem use it to pick an appropriate
+// machine shape; Start fails with an error of kind
+// errors.NotSupported if resources are requested from a system that
+// does not. Multiple Resources parameters may be passed, in which
+// case the most demanding requirements apply.
+type Resources struct {
+	// CPUs is the minimum number of processors.
+	CPUs int
+	// Memory is the minimum amount of system memory.
+	Memory data.Size
+	// Disk is the minimum amount of disk space available
+	// for temporary files.
+	Disk data.Size
+	// CPUFeatures is a set of CPU features (e.g., "intel_avx512")
+	// that must be supported by the machine's processors.
+	CPUFeatures []string
+}
+
+// IsZero tells whether r does not specify any requirements.
+func (r Resources) IsZero() bool {
+	return r.CPUs == 0 && r.Memory == 0 && r.Disk == 0 && len(r.CPUFeatures) == 0
+}
+
+// Max returns the resource requirements that satisfy both r and q.
+func (r Resources) Max(q Resources) Resources {
+	if q.CPUs > r.CPUs {
+		r.CPUs = q.CPUs
+	}
+	if q.Memory > r.Memory {
+		r.Memory = q.Memory
+	}
+	if q.Disk > r.Disk {
+		r.Disk = q.Disk
+	}
+	features := make(map[string]bool)
+	for _, f := range r.CPUFeatures {
+		features[f] = true
+	}
+	for _, f := range q.CPUFeatures {
+		if !features[f] {
+			features[f] = true
+			r.CPUFeatures = append(r.CPUFeatures[:len(r.CPUFeatures):len(r.CPUFeatures)], f)
+		}
+	}
+	return r
+}
+
+// Resources are applied by the system when machines are started.
+func (Resources) applyParam(*Machine) {}
+
+// CompressBinary is a machine parameter that, when true, compresses
+// the binary image as it is uploaded to the machine. This reduces
+// bootstrap time over slow links, at the cost of processor time on
+// the driver and the machine.
+type CompressBinary bool
+
+func (c CompressBinary) applyParam(m *Machine) {
+	m.compressBinary = bool(c)
+}
+
+// OnSystem is a machine parameter that names the system on which
+// machines are started. The system must be the B's primary system or
+// have been registered with it through the Systems option. If
+// multiple OnSystem parameters are passed, the last one applies.
+type OnSystem string
+
+// OnSystem is applied when machines are started.
+func (OnSystem) applyParam(*Machine) {}
+
 // Start launches up to n new machines and returns them. The machines are
 // configured according to the provided parameters. Each machine must
 // have at least one service exported, or else Start returns an
@@ -224,9 +508,42 @@ func (e Environ) applyParam(m *Machine) {
 // returned. Start maintains a keepalive to the returned machines,
 // thus tying the machines' lifetime with the caller process.
 //
+// Machines are started on the B's primary system, or on the system
+// named by an OnSystem parameter.
+//
+// Each machine is assigned a unique instance cookie, which is
+// embedded in its address. Calls to the address fail with
+// ErrInstanceMismatch if it is later served by a different instance.
+//
 // Start returns at least one machine, or else an error.
 func (b *B) Start(ctx context.Context, n int, params ...Param) ([]*Machine, error) {
-	machines, err := b.system.Start(ctx, n)
+	var (
+		resources Resources
+		system    = b.system
+	)
+	for _, p := range params {
+		switch p := p.(type) {
+		case Resources:
+			resources = resources.Max(p)
+		case OnSystem:
+			var ok bool
+			system, ok = b.systems[string(p)]
+			if !ok {
+				return nil, errors.E(errors.NotExist, fmt.Sprintf("system %s is not registered", p))
+			}
+		}
+	}
+	var (
+		machines []*Machine
+		err      error
+	)
+	if resources.IsZero() {
+		machines, err = system.Start(ctx, n)
+	} else if system, ok := system.(ResourceSystem); ok {
+		machines, err = system.StartResources(ctx, n, resources)
+	} else {
+		err = errors.E(errors.NotSupported, fmt.Sprintf("system %s does not support resource requirements", system.Name()))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -234,21 +551,47 @@ func (b *B) Start(ctx context.Context, n int, params ...Param) ([]*Machine, erro
 		return nil, errors.E(errors.Unavailable, "no machines started")
 	}
 	b.mu.Lock()
-	defer b.mu.Unlock()
 	for _, m := range machines {
 		for _, p := range params {
 			p.applyParam(m)
 		}
 		if len(m.services) == 0 {
+			b.mu.Unlock()
 			return nil, errors.E(errors.Invalid, "no services provided")
 		}
+		m.instance = newInstance()
+		m.Addr = withInstance(m.Addr, m.instance)
 		m.owner = true
+		m.system = system
 		m.start(b)
 		b.machines[m.Addr] = m
 	}
+	b.mu.Unlock()
+	b.persist(machines)
 	return machines, nil
 }
 
+// StopAll gracefully stops all of the machines owned by this B, as
+// by (*Machine).Stop. Each machine is drained independently: failure
+// to stop one machine does not cut short the others' stops. The
+// first error encountered is returned.
+func (b *B) StopAll(ctx context.Context) error {
+	var g errgroup.Group
+	for _, m := range b.Machines() {
+		if !m.Owned() || m.State() == Stopped {
+			continue
+		}
+		m := m
+		g.Go(func() error {
+			if err := m.Stop(ctx); err != nil {
+				return errors.E(fmt.Sprintf("stop %s", m.Addr), err)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
 // Machines returns a snapshot of the current set machines known to this B.
 func (b *B) Machines() []*Machine {
 	b.mu.Lock()
@@ -368,8 +711,19 @@ func (b *B) pprofIndex(w http.ResponseWriter, r *http.Request) {
 //	b := bigmachine.Start()
 //	defer b.Shutdown()
 //	// driver code
+//
+// Shutdown does not stop the session's machines, which exit once
+// their keepalives expire; use StopAll to release them eagerly.
 func (b *B) Shutdown() {
-	b.system.Shutdown()
+	runningMu.Lock()
+	delete(running, b)
+	runningMu.Unlock()
+	for _, system := range b.Systems() {
+		// Only systems initialized by this process are torn down.
+		if b.clients[system.Name()] != nil {
+			system.Shutdown()
+		}
+	}
 }
 
 // MaybeInit calls the method
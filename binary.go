@@ -0,0 +1,481 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/fatbin"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
+)
+
+const (
+	// maxCachedBinaries is the number of binaries kept in a machine's
+	// binary cache.
+	maxCachedBinaries = 4
+
+	// binaryFanout is the maximum number of concurrent binary
+	// transfers served by the driver, and by each peer machine.
+	binaryFanout = 4
+
+	// uploadChunkSize is the size of the chunks in which binaries
+	// are uploaded to machines.
+	uploadChunkSize = 4 << 20
+
+	// uploadCallTimeout is the timeout for each call made while
+	// uploading a binary.
+	uploadCallTimeout = time.Minute
+
+	// imageEnv is the environment variable that carries the digest
+	// of an image sent to Supervisor.Exec.
+	imageEnv = "BIGMACHINE_IMAGE"
+)
+
+// uploadRetryPolicy is the retry policy used to resume failed binary
+// uploads.
+var uploadRetryPolicy = retry.MaxTries(retry.Backoff(time.Second, 10*time.Second, 2), 5)
+
+var (
+	imageDigestsMu sync.Mutex
+	imageDigests   = make(map[string]digest.Digest)
+)
+
+// imageDigest returns the digest of the binary image, contained in
+// fatbin self, that is exec'd on machines of the provided platform.
+// Digests are computed once per platform.
+func imageDigest(self *fatbin.Reader, goos, goarch string) (digest.Digest, error) {
+	key := goos + "/" + goarch
+	imageDigestsMu.Lock()
+	defer imageDigestsMu.Unlock()
+	if d, ok := imageDigests[key]; ok {
+		return d, nil
+	}
+	rc, err := self.Open(goos, goarch)
+	if err != nil {
+		return digest.Digest{}, err
+	}
+	defer rc.Close()
+	dw := digester.NewWriter()
+	if _, err := io.Copy(dw, rc); err != nil {
+		return digest.Digest{}, err
+	}
+	d := dw.Digest()
+	imageDigests[key] = d
+	return d, nil
+}
+
+// binaryCacheDir returns the directory in which a machine caches the
+// binaries that have been exec'd on it.
+func binaryCacheDir() string {
+	return filepath.Join(os.TempDir(), "bigmachine-binaries")
+}
+
+// cachedBinary returns the path of the cached binary with the
+// provided digest.
+func cachedBinary(d digest.Digest) string {
+	return filepath.Join(binaryCacheDir(), d.Hex())
+}
+
+// verifyBinary checks that the binary at the provided path has
+// digest d, failing with an error of kind errors.Integrity if it does
+// not. Corrupted binaries are removed.
+func verifyBinary(path string, d digest.Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	dw := digester.NewWriter()
+	_, err = io.Copy(dw, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if got := dw.Digest(); got != d {
+		os.Remove(path)
+		return errors.E(errors.Integrity, fmt.Sprintf("binary %s: digest mismatch: got %v, want %v", path, got, d))
+	}
+	return nil
+}
+
+// cacheBinary writes the binary read from r into the machine's binary
+// cache, returning its path and digest. The least recently cached
+// binaries are evicted so that at most maxCachedBinaries remain.
+func cacheBinary(r io.Reader) (path string, d digest.Digest, err error) {
+	dir := binaryCacheDir()
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	dw := digester.NewWriter()
+	_, err = io.Copy(io.MultiWriter(f, dw), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0755)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	d = dw.Digest()
+	path = cachedBinary(d)
+	if err = os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	pruneBinaryCache(dir, path)
+	return
+}
+
+// pruneBinaryCache removes the oldest binaries in the cache directory
+// dir so that at most maxCachedBinaries remain. The binary at keep is
+// never removed.
+func pruneBinaryCache(dir, keep string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Error.Printf("binary cache %s: %v", dir, err)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	var n int
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.Name()[0] == '.' || path == keep {
+			continue
+		}
+		if n++; n < maxCachedBinaries {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Error.Printf("binary cache: remove %s: %v", path, err)
+		}
+	}
+}
+
+// BinarySources coordinates the distribution of binaries to
+// bootstrapping machines. Machines that are running a binary become
+// sources of that binary for other machines, so that binaries are
+// distributed in a tree rooted at the driver rather than all being
+// sent by the driver. Each source (including the driver) serves at
+// most binaryFanout transfers at a time.
+type binarySources struct {
+	mu sync.Mutex
+	// driver is the number of transfers currently served by the
+	// driver.
+	driver int
+	// peers stores, for each binary digest, the number of transfers
+	// currently served by each peer, keyed by address.
+	peers map[digest.Digest]map[string]int
+	// changed is closed (and replaced) whenever a source becomes
+	// available.
+	changed chan struct{}
+}
+
+func newBinarySources() *binarySources {
+	return &binarySources{
+		peers:   make(map[digest.Digest]map[string]int),
+		changed: make(chan struct{}),
+	}
+}
+
+// Add registers the machine at addr as a source of the binary with
+// digest d.
+func (s *binarySources) add(d digest.Digest, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers[d] == nil {
+		s.peers[d] = make(map[string]int)
+	}
+	if _, ok := s.peers[d][addr]; !ok {
+		s.peers[d][addr] = 0
+	}
+	s.notify()
+}
+
+// Remove unregisters the machine at addr as a source of the binary
+// with digest d.
+func (s *binarySources) remove(d digest.Digest, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers[d], addr)
+}
+
+// Acquire waits for a source of the binary with digest d to become
+// available, and reserves it. Peer sources are preferred, least
+// loaded first, unless usePeers is false; acquire returns an empty
+// peer address if the driver should serve the binary itself. The
+// returned function must be called to release the source when the
+// transfer is done.
+func (s *binarySources) acquire(ctx context.Context, d digest.Digest, usePeers bool) (peer string, release func(), err error) {
+	for {
+		s.mu.Lock()
+		load := binaryFanout
+		for addr, n := range s.peers[d] {
+			if usePeers && n < load {
+				peer, load = addr, n
+			}
+		}
+		if peer != "" {
+			s.peers[d][peer]++
+			s.mu.Unlock()
+			return peer, func() { s.release(d, peer) }, nil
+		}
+		if s.driver < binaryFanout {
+			s.driver++
+			s.mu.Unlock()
+			return "", func() { s.release(d, "") }, nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+	}
+}
+
+func (s *binarySources) release(d digest.Digest, peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if peer == "" {
+		s.driver--
+	} else if _, ok := s.peers[d][peer]; ok {
+		s.peers[d][peer]--
+	}
+	s.notify()
+}
+
+// notify wakes up waiters for sources. It must be called with s.mu
+// held.
+func (s *binarySources) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// An uploadChunk is a chunk of a binary image that is uploaded to a
+// machine by Supervisor.UploadChunk.
+type uploadChunk struct {
+	// Image is the digest of the complete image.
+	Image digest.Digest
+	// Offset is the offset of the chunk in the image.
+	Offset int64
+	// Data is the chunk's data. It is gzip-compressed if Compressed
+	// is set.
+	Data       []byte
+	Compressed bool
+	// Size is the size of the chunk's uncompressed data. Compressed
+	// chunks are decompressed up to this size.
+	Size int64
+	// Digest is the digest of the chunk's uncompressed data.
+	Digest digest.Digest
+}
+
+// partialBinary returns the path of the partially uploaded binary
+// with the provided digest.
+func partialBinary(d digest.Digest) string {
+	return filepath.Join(binaryCacheDir(), ".partial-"+d.Hex())
+}
+
+// upload uploads the binary image with digest image to the machine
+// in verified chunks, and then execs it. Uploads are resumed from the
+// last acknowledged offset after failures. If the machine does not
+// support chunked uploads (e.g., it runs a bootstrap binary), the
+// image is sent through Supervisor.Exec instead.
+func (m *Machine) upload(ctx context.Context, self *fatbin.Reader, info Info, image digest.Digest) error {
+	for retries := 0; ; retries++ {
+		err := m.uploadChunks(ctx, self, info, image)
+		if err == nil {
+			break
+		}
+		if err == errUploadUnsupported {
+			callCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+			defer cancel()
+			// The image's digest is passed through the environment, so
+			// that supervisors can verify the image before exec'ing it.
+			environ := append(m.execEnviron(), imageEnv+"="+image.String())
+			if err := m.call(callCtx, "Supervisor.Setenv", environ, nil); err != nil {
+				return err
+			}
+			rc, err := self.Open(info.Goos, info.Goarch)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			return m.call(callCtx, "Supervisor.Exec", rc, nil)
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Error.Printf("%s: binary upload failed: %v; resuming", m.Addr, err)
+		if retry.Wait(ctx, uploadRetryPolicy, retries) != nil {
+			return err
+		}
+	}
+	callCtx, cancel := context.WithTimeout(ctx, uploadCallTimeout)
+	defer cancel()
+	return m.call(callCtx, "Supervisor.ExecUpload", image, nil)
+}
+
+// uploadChunks uploads the binary image to the machine, beginning at
+// the offset last acknowledged by the machine.
+func (m *Machine) uploadChunks(ctx context.Context, self *fatbin.Reader, info Info, image digest.Digest) error {
+	if !info.ChunkedUpload {
+		return errUploadUnsupported
+	}
+	var offset int64
+	callCtx, cancel := context.WithTimeout(ctx, uploadCallTimeout)
+	err := m.call(callCtx, "Supervisor.UploadOffset", image, &offset)
+	cancel()
+	if err != nil {
+		return err
+	}
+	rc, err := self.Open(info.Goos, info.Goarch)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if _, err := io.CopyN(ioutil.Discard, rc, offset); err != nil {
+		return err
+	}
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, err := io.ReadFull(rc, buf)
+		if err == io.EOF {
+			return nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		chunk := uploadChunk{
+			Image:      image,
+			Offset:     offset,
+			Data:       buf[:n],
+			Compressed: m.compressBinary,
+			Size:       int64(n),
+			Digest:     digester.FromBytes(buf[:n]),
+		}
+		if chunk.Compressed {
+			var b bytes.Buffer
+			w, _ := gzip.NewWriterLevel(&b, gzip.BestSpeed)
+			if _, err := w.Write(chunk.Data); err != nil {
+				return err
+			}
+			if err := w.Close(); err != nil {
+				return err
+			}
+			chunk.Data = b.Bytes()
+		}
+		callCtx, cancel := context.WithTimeout(ctx, uploadCallTimeout)
+		err = m.call(callCtx, "Supervisor.UploadChunk", chunk, &offset)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// errUploadUnsupported is returned by uploadChunks when the machine
+// does not advertise support for chunked uploads in its Info.
+var errUploadUnsupported = errors.New("chunked uploads not supported")
+
+// writeChunk verifies the provided chunk and appends it to its
+// partially uploaded binary, returning the binary's new size.
+func writeChunk(chunk uploadChunk) (_ int64, err error) {
+	if err := os.MkdirAll(binaryCacheDir(), 0777); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(partialBinary(chunk.Image), os.O_WRONLY|os.O_CREATE, 0755)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if size := info.Size(); chunk.Offset != size {
+		return 0, errors.E(errors.Precondition, fmt.Sprintf("chunk offset %d does not match uploaded size %d", chunk.Offset, size))
+	}
+	data := chunk.Data
+	if chunk.Compressed {
+		if chunk.Size < 0 || chunk.Size > uploadChunkSize {
+			return 0, errors.E(errors.Invalid, fmt.Sprintf("chunk at offset %d: invalid size %d", chunk.Offset, chunk.Size))
+		}
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return 0, errors.E(errors.Integrity, "decompress chunk", err)
+		}
+		// Read one byte past the declared size, so that chunks that
+		// decompress to more data are detected without decompressing
+		// them fully.
+		data, err = ioutil.ReadAll(io.LimitReader(r, chunk.Size+1))
+		if err != nil {
+			return 0, errors.E(errors.Integrity, "decompress chunk", err)
+		}
+		if int64(len(data)) > chunk.Size {
+			return 0, errors.E(errors.Integrity, fmt.Sprintf("chunk at offset %d: decompresses to more than %d bytes", chunk.Offset, chunk.Size))
+		}
+	}
+	if got, want := digester.FromBytes(data), chunk.Digest; got != want {
+		return 0, errors.E(errors.Integrity, fmt.Sprintf("chunk at offset %d: digest mismatch: got %v, want %v", chunk.Offset, got, want))
+	}
+	if _, err := f.WriteAt(data, chunk.Offset); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return chunk.Offset + int64(len(data)), nil
+}
+
+// commitUpload verifies the digest of the completely uploaded binary
+// with digest d and moves it into the binary cache, returning its
+// path. Corrupted uploads are discarded.
+func commitUpload(d digest.Digest) (string, error) {
+	partial := partialBinary(d)
+	f, err := os.Open(partial)
+	if err != nil {
+		return "", err
+	}
+	dw := digester.NewWriter()
+	_, err = io.Copy(dw, f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if got := dw.Digest(); got != d {
+		os.Remove(partial)
+		return "", errors.E(errors.Integrity, fmt.Sprintf("uploaded binary: digest mismatch: got %v, want %v", got, d))
+	}
+	path := cachedBinary(d)
+	if err := os.Rename(partial, path); err != nil {
+		return "", err
+	}
+	pruneBinaryCache(binaryCacheDir(), path)
+	return path, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/testutil"
+)
+
+func TestBinarySources(t *testing.T) {
+	var (
+		s   = newBinarySources()
+		d   = digester.FromString("binary")
+		ctx = context.Background()
+	)
+	var releases []func()
+	for i := 0; i < binaryFanout; i++ {
+		peer, release, err := s.acquire(ctx, d, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peer != "" {
+			t.Fatalf("unexpected peer %s", peer)
+		}
+		releases = append(releases, release)
+	}
+	// The driver is saturated, so we must wait for a source.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	_, _, err := s.acquire(timeoutCtx, d, true)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("bad error %v", err)
+	}
+	type result struct {
+		peer    string
+		release func()
+	}
+	c := make(chan result)
+	go func() {
+		peer, release, err := s.acquire(ctx, d, true)
+		if err != nil {
+			t.Error(err)
+		}
+		c <- result{peer, release}
+	}()
+	s.add(d, "peer")
+	r := <-c
+	if got, want := r.peer, "peer"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Peers are not used unless requested.
+	go func() {
+		peer, release, err := s.acquire(ctx, d, false)
+		if err != nil {
+			t.Error(err)
+		}
+		c <- result{peer, release}
+	}()
+	releases[0]()
+	r = <-c
+	if got, want := r.peer, ""; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Sources are balanced across peers.
+	s.add(d, "peer2")
+	peer, _, err := s.acquire(ctx, d, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := peer, "peer2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUploadChunks(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	t.Setenv("TMPDIR", dir)
+
+	data := []byte("a binary image, uploaded in chunks")
+	image := digester.FromBytes(data)
+	chunk := func(offset, end int, compress bool) uploadChunk {
+		c := uploadChunk{
+			Image:  image,
+			Offset: int64(offset),
+			Data:   data[offset:end],
+			Size:   int64(end - offset),
+			Digest: digester.FromBytes(data[offset:end]),
+		}
+		if compress {
+			var b bytes.Buffer
+			w := gzip.NewWriter(&b)
+			w.Write(c.Data)
+			w.Close()
+			c.Data, c.Compressed = b.Bytes(), true
+		}
+		return c
+	}
+	offset, err := writeChunk(chunk(0, 10, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := offset, int64(10); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Chunks must be written at the end of the partial upload.
+	if _, err := writeChunk(chunk(20, 30, false)); !errors.Is(errors.Precondition, err) {
+		t.Errorf("bad error %v", err)
+	}
+	// Corrupted chunks are rejected.
+	bad := chunk(10, 20, false)
+	bad.Data = []byte("corrupted!")
+	if _, err := writeChunk(bad); !errors.Is(errors.Integrity, err) {
+		t.Errorf("bad error %v", err)
+	}
+	// Compressed chunks may not decompress beyond their declared size.
+	big := chunk(10, len(data), true)
+	big.Size--
+	if _, err := writeChunk(big); !errors.Is(errors.Integrity, err) {
+		t.Errorf("bad error %v", err)
+	}
+	offset, err = writeChunk(chunk(10, len(data), true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := offset, int64(len(data)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	path, err := commitUpload(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data) {
+		t.Errorf("got %q, want %q", p, data)
+	}
+	if err := verifyBinary(path, image); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupted binaries fail verification and are evicted.
+	if err := ioutil.WriteFile(path, []byte("corrupted!"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyBinary(path, image); !errors.Is(errors.Integrity, err) {
+		t.Errorf("bad error %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("corrupted binary not removed: %v", err)
+	}
+
+	// Corrupted uploads are never committed.
+	other := digester.FromString("other")
+	if _, err := writeChunk(uploadChunk{Image: other, Data: data, Digest: image}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commitUpload(other); !errors.Is(errors.Integrity, err) {
+		t.Errorf("bad error %v", err)
+	}
+	if _, err := os.Stat(partialBinary(other)); !os.IsNotExist(err) {
+		t.Errorf("partial upload not removed: %v", err)
+	}
+}
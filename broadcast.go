@@ -0,0 +1,156 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+)
+
+// A BroadcastResult is the result of a broadcast call to a single
+// machine.
+type BroadcastResult struct {
+	// Machine is the machine that was called.
+	Machine *Machine
+	// Reply is the reply returned by the machine, as allocated by
+	// the broadcast's newReply function. It is nil if the call
+	// was not made.
+	Reply interface{}
+	// Err is the error returned by the call, if any.
+	Err error
+}
+
+// A BroadcastOption configures a broadcast; see (*B).Broadcast.
+type BroadcastOption func(*broadcastConfig)
+
+type broadcastConfig struct {
+	concurrency int
+	quorum      int
+	timeout     time.Duration
+}
+
+// BroadcastConcurrency limits the number of calls made concurrently
+// by a broadcast. By default, all machines are called concurrently.
+func BroadcastConcurrency(n int) BroadcastOption {
+	return func(c *broadcastConfig) {
+		c.concurrency = n
+	}
+}
+
+// BroadcastQuorum completes a broadcast once n calls have succeeded.
+// Outstanding calls are then canceled, and remaining calls are not
+// made. The broadcast fails if a quorum cannot be reached.
+func BroadcastQuorum(n int) BroadcastOption {
+	return func(c *broadcastConfig) {
+		c.quorum = n
+	}
+}
+
+// BroadcastTimeout sets a timeout for each call made by a broadcast.
+func BroadcastTimeout(d time.Duration) BroadcastOption {
+	return func(c *broadcastConfig) {
+		c.timeout = d
+	}
+}
+
+// errQuorum is the error assigned to calls that were canceled or not
+// made because a broadcast reached its quorum.
+var errQuorum = errors.E(errors.Canceled, "broadcast quorum reached")
+
+// Broadcast calls the provided service method on each of the provided
+// machines with the same argument, and gathers their replies. Replies
+// are allocated by newReply, which should return a pointer suitable
+// for use as a reply to (*Machine).Call. Broadcast returns a result
+// for each machine, in the order in which the machines were provided.
+//
+// If any call fails, Broadcast returns an error describing the first
+// failed machine; all of the per-machine errors are available in the
+// results. If a quorum is configured (see BroadcastQuorum),
+// Broadcast instead succeeds once the quorum is reached, and fails
+// only if it cannot be.
+func (b *B) Broadcast(ctx context.Context, machines []*Machine, serviceMethod string, arg interface{}, newReply func() interface{}, opts ...BroadcastOption) ([]BroadcastResult, error) {
+	var config broadcastConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.quorum > len(machines) {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("quorum %d exceeds number of machines %d", config.quorum, len(machines)))
+	}
+	concurrency := config.concurrency
+	if concurrency <= 0 || concurrency > len(machines) {
+		concurrency = len(machines)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		results = make([]BroadcastResult, len(machines))
+		sem     = make(chan struct{}, concurrency)
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		ok      int
+		// quorum is set when the broadcast's quorum is reached.
+		quorum bool
+	)
+	for i, m := range machines {
+		results[i].Machine = m
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			mu.Lock()
+			if quorum {
+				err = errQuorum
+			}
+			results[i].Err = err
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, m *Machine) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			callCtx := ctx
+			if config.timeout > 0 {
+				var cancel func()
+				callCtx, cancel = context.WithTimeout(ctx, config.timeout)
+				defer cancel()
+			}
+			reply := newReply()
+			err := m.Call(callCtx, serviceMethod, arg, reply)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				ok++
+				if config.quorum > 0 && ok == config.quorum {
+					quorum = true
+					cancel()
+				}
+			case quorum:
+				err = errQuorum
+			}
+			results[i].Reply = reply
+			results[i].Err = err
+		}(i, m)
+	}
+	wg.Wait()
+	if config.quorum > 0 {
+		if !quorum {
+			return results, errors.E(errors.Unavailable, fmt.Sprintf("%s: %d of %d calls succeeded; quorum is %d", serviceMethod, ok, len(machines), config.quorum))
+		}
+		return results, nil
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			return results, errors.E(fmt.Sprintf("%s %s", r.Machine.Addr, serviceMethod), r.Err)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,301 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+const (
+	// memoryCheckPeriod is the period at which supervisors check
+	// their cgroup's memory events and pressure.
+	memoryCheckPeriod = 5 * time.Second
+	// defaultMemoryPressure is the default share of time (as a
+	// percentage) during which all of a cgroup's processes may be
+	// stalled on memory before memory pressure is reported.
+	defaultMemoryPressure = 10
+)
+
+// cgroupRoots are the mount points at which the cgroup v2 hierarchy
+// is looked for: the first is used by "unified" systems, the second
+// by "hybrid" ones.
+var cgroupRoots = []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"}
+
+// cgroupDir returns the directory of the cgroup v2 group of the
+// process with the provided pid (or "self"). It returns an error of
+// kind errors.NotSupported if the process's group does not have a
+// memory controller, for example because the system uses cgroup v1.
+func cgroupDir(pid string) (string, error) {
+	p, err := ioutil.ReadFile(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return "", errors.E(errors.NotSupported, "cgroups", err)
+	}
+	var path string
+	for _, line := range strings.Split(string(p), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			path = strings.TrimPrefix(line, "0::")
+			break
+		}
+	}
+	if path == "" {
+		return "", errors.E(errors.NotSupported, "no cgroup v2 group")
+	}
+	for _, root := range cgroupRoots {
+		dir := filepath.Join(root, path)
+		if _, err := os.Stat(filepath.Join(dir, "memory.events")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", errors.E(errors.NotSupported, fmt.Sprintf("cgroup %s has no memory controller", path))
+}
+
+// memoryEvents are the counters reported by a cgroup's
+// memory.events file.
+type memoryEvents struct {
+	// OOM is the number of times the group's memory limit was
+	// reached and the OOM killer was invoked.
+	OOM int64
+	// OOMKill is the number of processes in the group that were
+	// killed by the OOM killer.
+	OOMKill int64
+}
+
+// readMemoryEvents reads the memory events of the cgroup in the
+// provided directory.
+func readMemoryEvents(dir string) (memoryEvents, error) {
+	var events memoryEvents
+	err := scanCgroupFile(filepath.Join(dir, "memory.events"), func(fields []string) error {
+		if len(fields) != 2 {
+			return nil
+		}
+		var p *int64
+		switch fields[0] {
+		case "oom":
+			p = &events.OOM
+		case "oom_kill":
+			p = &events.OOMKill
+		default:
+			return nil
+		}
+		var err error
+		*p, err = strconv.ParseInt(fields[1], 10, 64)
+		return err
+	})
+	return events, err
+}
+
+// memoryPressure is the memory pressure stall information (PSI)
+// reported by a cgroup's memory.pressure file: the percentage of
+// time, averaged over the last 10 seconds, during which some or
+// all of the group's processes were stalled on memory.
+type memoryPressure struct {
+	Some, Full float64
+}
+
+// readMemoryPressure reads the memory pressure of the cgroup in the
+// provided directory.
+func readMemoryPressure(dir string) (memoryPressure, error) {
+	var pressure memoryPressure
+	err := scanCgroupFile(filepath.Join(dir, "memory.pressure"), func(fields []string) error {
+		var p *float64
+		switch fields[0] {
+		case "some":
+			p = &pressure.Some
+		case "full":
+			p = &pressure.Full
+		default:
+			return nil
+		}
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "avg10=") {
+				continue
+			}
+			var err error
+			*p, err = strconv.ParseFloat(strings.TrimPrefix(field, "avg10="), 64)
+			return err
+		}
+		return nil
+	})
+	return pressure, err
+}
+
+// scanCgroupFile calls fn with the whitespace-separated fields of
+// each nonempty line of the provided cgroup file.
+func scanCgroupFile(path string, fn func(fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(fields); err != nil {
+			return errors.E(errors.Invalid, fmt.Sprintf("%s: %q", path, scan.Text()), err)
+		}
+	}
+	return scan.Err()
+}
+
+// watchMemory periodically reads the memory events and pressure of
+// the supervisor's cgroup until the provided context is done. OOM
+// kills within the group and excessive memory pressure are recorded
+// so that they may be reported to the driver through keepalives.
+func (s *Supervisor) watchMemory(ctx context.Context) {
+	dir, err := cgroupDir("self")
+	if err != nil {
+		log.Printf("not monitoring cgroup memory: %v", err)
+		return
+	}
+	start, err := readMemoryEvents(dir)
+	if err != nil {
+		log.Error.Printf("not monitoring cgroup memory: %v", err)
+		return
+	}
+	tick := time.NewTicker(memoryCheckPeriod)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		events, err := readMemoryEvents(dir)
+		if err != nil {
+			log.Error.Printf("failed to read cgroup memory events: %v", err)
+			continue
+		}
+		var pressured string
+		if pressure, err := readMemoryPressure(dir); err != nil {
+			log.Error.Printf("failed to read cgroup memory pressure: %v", err)
+		} else {
+			s.mu.Lock()
+			threshold := s.thresholds.MemoryPressure
+			s.mu.Unlock()
+			if threshold == 0 {
+				threshold = defaultMemoryPressure
+			}
+			if pressure.Full > threshold {
+				pressured = fmt.Sprintf("processes stalled on memory %.1f%% of the time", pressure.Full)
+			}
+		}
+		s.mu.Lock()
+		if kills := events.OOMKill - start.OOMKill; kills > s.oomKills {
+			log.Error.Printf("%d processes in cgroup %s killed by the OOM killer", kills-s.oomKills, dir)
+			s.oomKills = kills
+		}
+		if pressured != "" && s.memoryPressure == "" {
+			log.Error.Printf("memory pressure: %s", pressured)
+		}
+		s.memoryPressure = pressured
+		s.mu.Unlock()
+	}
+}
+
+// oomKilled tells whether an exited process, whose cgroup had the
+// provided memory events when the process started, was killed by
+// the OOM killer. It is conservative: the process must have been
+// killed by SIGKILL, and its cgroup must have recorded a
+// subsequent OOM kill.
+func oomKilled(state *os.ProcessState, dir string, start memoryEvents) bool {
+	if state == nil || dir == "" {
+		return false
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); !ok || !status.Signaled() || status.Signal() != syscall.SIGKILL {
+		return false
+	}
+	events, err := readMemoryEvents(dir)
+	if err != nil {
+		log.Error.Printf("failed to read cgroup memory events: %v", err)
+		return false
+	}
+	return events.OOMKill > start.OOMKill
+}
+
+// cpuPeriod is the period, in microseconds, over which CPU limits
+// are enforced for cgroups created by bigmachine.
+const cpuPeriod = 100000
+
+// createCgroup creates a cgroup v2 group with the provided name in
+// the parent directory, which must be a delegated group without
+// processes of its own. The group's processes are limited to the
+// provided number of CPUs and amount of memory; zero values impose no
+// limit. The directory of the new group is returned.
+func createCgroup(parent, name string, cpus int, memory data.Size) (string, error) {
+	if err := enableControllers(parent, "cpu", "memory"); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(parent, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", errors.E("create cgroup", err)
+	}
+	var limits [][2]string
+	if memory > 0 {
+		limits = append(limits, [2]string{"memory.max", strconv.FormatInt(memory.Bytes(), 10)})
+	}
+	if cpus > 0 {
+		limits = append(limits, [2]string{"cpu.max", fmt.Sprintf("%d %d", cpus*cpuPeriod, cpuPeriod)})
+	}
+	for _, limit := range limits {
+		if err := ioutil.WriteFile(filepath.Join(dir, limit[0]), []byte(limit[1]), 0644); err != nil {
+			os.Remove(dir)
+			return "", errors.E("set cgroup limit", limit[0], err)
+		}
+	}
+	return dir, nil
+}
+
+// enableControllers enables the provided controllers for the
+// children of the cgroup in the provided directory, if they are not
+// already enabled.
+func enableControllers(dir string, controllers ...string) error {
+	path := filepath.Join(dir, "cgroup.subtree_control")
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.E("enable cgroup controllers", err)
+	}
+	enabled := make(map[string]bool)
+	for _, c := range strings.Fields(string(p)) {
+		enabled[c] = true
+	}
+	var enable []string
+	for _, c := range controllers {
+		if !enabled[c] {
+			enable = append(enable, "+"+c)
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(enable, " ")), 0644); err != nil {
+		return errors.E("enable cgroup controllers", err)
+	}
+	return nil
+}
+
+// addToCgroup moves the process with the provided pid into the
+// cgroup in the provided directory.
+func addToCgroup(dir string, pid int) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return errors.E("add process to cgroup", err)
+	}
+	return nil
+}
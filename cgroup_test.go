@@ -0,0 +1,91 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/testutil"
+)
+
+func TestCgroupMemory(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for name, contents := range map[string]string{
+		"memory.events": `low 0
+high 0
+max 12
+oom 3
+oom_kill 2
+oom_group_kill 0
+`,
+		"memory.pressure": `some avg10=42.50 avg60=10.00 avg300=2.00 total=123456
+full avg10=12.25 avg60=3.00 avg300=0.50 total=65432
+`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := readMemoryEvents(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := events, (memoryEvents{OOM: 3, OOMKill: 2}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	pressure, err := readMemoryPressure(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pressure, (memoryPressure{Some: 42.5, Full: 12.25}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte("oom_kill lots\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMemoryEvents(dir); !errors.Is(errors.Invalid, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestCreateCgroup(t *testing.T) {
+	parent, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	control := filepath.Join(parent, "cgroup.subtree_control")
+	if err := ioutil.WriteFile(control, []byte("memory io\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := createCgroup(parent, "machine", 2, 512*data.MiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addToCgroup(dir, 1234); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		control:                            "+cpu",
+		filepath.Join(dir, "memory.max"):   "536870912",
+		filepath.Join(dir, "cpu.max"):      "200000 100000",
+		filepath.Join(dir, "cgroup.procs"): "1234",
+	} {
+		p, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(p); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+	// Groups must be created in a parent that permits them.
+	if _, err := createCgroup(dir, "child", 0, 0); err == nil {
+		t.Error("expected error")
+	}
+}
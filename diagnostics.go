@@ -0,0 +1,266 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/log"
+)
+
+const (
+	// defaultDiagnosticsInterval is the default minimum amount of
+	// time between diagnostics captures for a machine.
+	defaultDiagnosticsInterval = 10 * time.Minute
+	// defaultDiagnosticsKeep is the default number of diagnostics
+	// bundles kept for a machine.
+	defaultDiagnosticsKeep = 5
+	// diagnosticsTimeout is the amount of time given to each
+	// diagnostics capture.
+	diagnosticsTimeout = time.Minute
+)
+
+// A DiagnosticsConfig configures the capture of diagnostics from
+// unhealthy machines (see UnhealthyProfile). Each capture produces a
+// bundle containing the machine's heap profile, goroutine dump,
+// expvars, and memory information. Each machine's bundles are
+// written to a per-machine directory under Dir, together with a
+// manifest (manifest.json) that lists the machine's bundles and,
+// once the machine stops, its error.
+type DiagnosticsConfig struct {
+	// Dir is the directory to which diagnostics are written. It
+	// defaults to bigmachine-diagnostics in the temporary directory.
+	Dir string
+	// Interval is the minimum amount of time between captures for a
+	// single machine. It defaults to 10 minutes.
+	Interval time.Duration
+	// Keep is the number of bundles kept for each machine; older
+	// bundles are removed. It defaults to 5.
+	Keep int
+}
+
+// Diagnostics is an option that configures the capture of
+// diagnostics from unhealthy machines.
+func Diagnostics(config DiagnosticsConfig) Option {
+	return func(b *B) {
+		b.diagnostics = config
+	}
+}
+
+// diagnosticsConfig returns the B's diagnostics configuration, with
+// defaults applied.
+func (b *B) diagnosticsConfig() DiagnosticsConfig {
+	config := b.diagnostics
+	if config.Dir == "" {
+		config.Dir = filepath.Join(os.TempDir(), "bigmachine-diagnostics")
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultDiagnosticsInterval
+	}
+	if config.Keep <= 0 {
+		config.Keep = defaultDiagnosticsKeep
+	}
+	return config
+}
+
+// A diagnosticsManifest describes the diagnostics captured for a
+// machine.
+type diagnosticsManifest struct {
+	// Machine is the address of the machine.
+	Machine string
+	// Bundles are the machine's retained bundles, oldest first.
+	Bundles []diagnosticsBundle
+	// Err is the machine's error, once it has stopped.
+	Err string `json:",omitempty"`
+	// Failure classifies the machine's error.
+	Failure string `json:",omitempty"`
+}
+
+// A diagnosticsBundle describes a single diagnostics capture.
+type diagnosticsBundle struct {
+	// Dir is the bundle's directory, relative to the manifest.
+	Dir string
+	// Time is the time of the capture.
+	Time time.Time
+	// Reason is the reason the machine was unhealthy.
+	Reason string
+	// Files are the names of the files in the bundle.
+	Files []string
+	// Errors are the errors encountered while capturing.
+	Errors []string `json:",omitempty"`
+}
+
+// diagnosticsDir returns the directory in which diagnostics for
+// machine m are written. The directory is named by the machine's
+// host and instance cookie, so that successive machines served at
+// the same address do not share diagnostics.
+func (m *Machine) diagnosticsDir(config DiagnosticsConfig) string {
+	name := m.Addr
+	if u, err := url.Parse(m.Addr); err == nil && u.Host != "" {
+		name = u.Host
+		if instance := instanceOf(m.Addr); instance != "" {
+			name += "-" + instance
+		}
+	}
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', ':', '\\':
+			return '_'
+		}
+		return r
+	}, name)
+	return filepath.Join(config.Dir, name)
+}
+
+// captureDiagnostics captures a diagnostics bundle from the machine,
+// which has been reported unhealthy for the provided reason. Captures
+// are rate limited: captureDiagnostics does nothing if the previous
+// capture was made less than the configured interval ago, or if it
+// is still in progress. The capture runs in the background, so that
+// it does not delay the machine's keepalives. CaptureDiagnostics
+// must be called only from the machine's loop.
+func (m *Machine) captureDiagnostics(ctx context.Context, reason string) {
+	if m.b == nil {
+		return
+	}
+	config := m.b.diagnosticsConfig()
+	now := time.Now()
+	if !m.lastDiagnostics.IsZero() && now.Sub(m.lastDiagnostics) < config.Interval {
+		return
+	}
+	if m.diagnosticsDone != nil {
+		select {
+		case <-m.diagnosticsDone:
+		default:
+			return
+		}
+	}
+	m.lastDiagnostics = now
+	done := make(chan struct{})
+	m.diagnosticsDone = done
+	go func() {
+		defer close(done)
+		m.saveDiagnostics(ctx, config, now, reason)
+	}()
+}
+
+// saveDiagnostics saves a diagnostics bundle, captured at the
+// provided time, to the machine's diagnostics directory.
+func (m *Machine) saveDiagnostics(ctx context.Context, config DiagnosticsConfig, now time.Time, reason string) {
+	ctx, cancel := context.WithTimeout(ctx, diagnosticsTimeout)
+	defer cancel()
+
+	dir := m.diagnosticsDir(config)
+	bundle := diagnosticsBundle{
+		Dir:    now.Format("20060102T150405.000"),
+		Time:   now,
+		Reason: reason,
+	}
+	path := filepath.Join(dir, bundle.Dir)
+	if err := os.MkdirAll(path, 0777); err != nil {
+		log.Error.Printf("%s: diagnostics: %v", m.Addr, err)
+		return
+	}
+	for _, capture := range []struct {
+		name string
+		save func(path string) error
+	}{
+		{"heap.pprof", func(path string) error {
+			return m.saveProfile(ctx, profileRequest{Name: "heap"}, path)
+		}},
+		{"goroutine.txt", func(path string) error {
+			return m.saveProfile(ctx, profileRequest{Name: "goroutine", Debug: 2}, path)
+		}},
+		{"vars.json", func(path string) error {
+			return m.saveExpvars(ctx, path)
+		}},
+		{"meminfo.json", func(path string) error {
+			info, err := m.MemInfo(ctx, true)
+			if err != nil {
+				return err
+			}
+			return writeJSON(path, info)
+		}},
+	} {
+		if err := capture.save(filepath.Join(path, capture.name)); err != nil {
+			bundle.Errors = append(bundle.Errors, fmt.Sprintf("%s: %v", capture.name, err))
+			continue
+		}
+		bundle.Files = append(bundle.Files, capture.name)
+	}
+	manifest := readDiagnosticsManifest(dir)
+	manifest.Machine = m.Addr
+	manifest.Bundles = append(manifest.Bundles, bundle)
+	if n := len(manifest.Bundles) - config.Keep; n > 0 {
+		for _, old := range manifest.Bundles[:n] {
+			if err := os.RemoveAll(filepath.Join(dir, old.Dir)); err != nil {
+				log.Error.Printf("%s: diagnostics: %v", m.Addr, err)
+			}
+		}
+		manifest.Bundles = manifest.Bundles[n:]
+	}
+	if err := writeJSON(filepath.Join(dir, "manifest.json"), manifest); err != nil {
+		log.Error.Printf("%s: diagnostics: %v", m.Addr, err)
+	}
+	log.Printf("%s: diagnostics saved to %s", m.Addr, path)
+}
+
+// finishDiagnostics records the machine's error in its diagnostics
+// manifest, if any diagnostics were captured, once any capture in
+// progress completes. It is called once the machine has stopped.
+func (m *Machine) finishDiagnostics() {
+	if m.b == nil || m.lastDiagnostics.IsZero() {
+		return
+	}
+	if m.diagnosticsDone != nil {
+		<-m.diagnosticsDone
+	}
+	dir := m.diagnosticsDir(m.b.diagnosticsConfig())
+	manifest := readDiagnosticsManifest(dir)
+	if err := m.Err(); err != nil {
+		manifest.Err = err.Error()
+	}
+	manifest.Failure = m.Failure().String()
+	if err := writeJSON(filepath.Join(dir, "manifest.json"), manifest); err != nil {
+		log.Error.Printf("%s: diagnostics: %v", m.Addr, err)
+	}
+}
+
+// readDiagnosticsManifest reads the diagnostics manifest in the
+// provided directory. An empty manifest is returned if it cannot be
+// read.
+func readDiagnosticsManifest(dir string) diagnosticsManifest {
+	var manifest diagnosticsManifest
+	p, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err == nil {
+		err = json.Unmarshal(p, &manifest)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Error.Printf("diagnostics: reading manifest in %s: %v", dir, err)
+	}
+	return manifest
+}
+
+// writeJSON atomically writes the JSON encoding of v to the provided
+// path.
+func writeJSON(path string, v interface{}) error {
+	p, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/shirou/gopsutil/disk"
+)
+
+const (
+	// diskCheckPeriod is the period at which supervisors check
+	// whether their machine's disks are exhausted.
+	diskCheckPeriod = 10 * time.Second
+	// diskExhaustedSize is the amount of free space below which a
+	// disk is considered exhausted.
+	diskExhaustedSize = 16 * data.MiB
+)
+
+// ErrDiskFull is the error with which a machine fails when one of
+// its monitored disks (see HealthThresholds) is exhausted. Its kind,
+// errors.Unavailable, is shared with other failures (e.g., of
+// unhealthy or draining machines), so the kind alone does not
+// identify it: callers should instead test the machine's Failure for
+// FailureDiskFull, or match its Err with errors.Match.
+var ErrDiskFull = errors.E(errors.Unavailable, "machine disk exhausted")
+
+// A diskFull describes an exhausted disk.
+type diskFull struct {
+	// Path is the monitored path that resides on the disk.
+	Path string
+	// Total and Free are the disk's total size and its free space.
+	Total, Free data.Size
+}
+
+func (d diskFull) String() string {
+	return fmt.Sprintf("%s: %s of %s free", d.Path, d.Free, d.Total)
+}
+
+// diskPaths returns the paths whose disks are monitored by the
+// supervisor: the temporary directory, and the configured data
+// paths.
+func (s *Supervisor) diskPaths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{os.TempDir()}, s.thresholds.DataPaths...)
+}
+
+// watchDisks periodically checks the machine's monitored disks
+// until the provided context is done, recording the first exhausted
+// disk it finds.
+func (s *Supervisor) watchDisks(ctx context.Context) {
+	tick := time.NewTicker(diskCheckPeriod)
+	defer tick.Stop()
+	for {
+		full := checkDisks(s.diskPaths())
+		s.mu.Lock()
+		if full != nil && s.diskFull == nil {
+			log.Error.Printf("disk exhausted: %s", full)
+		}
+		s.diskFull = full
+		s.mu.Unlock()
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkDisks returns the first of the provided paths whose disk is
+// exhausted, or nil if none are.
+func checkDisks(paths []string) *diskFull {
+	for _, path := range paths {
+		usage, err := disk.Usage(path)
+		if err != nil {
+			log.Error.Printf("failed to retrieve disk usage for %s: %v", path, err)
+			continue
+		}
+		if free := data.Size(usage.Free); free < diskExhaustedSize {
+			return &diskFull{Path: path, Total: data.Size(usage.Total), Free: free}
+		}
+	}
+	return nil
+}
+
+// DiskGrowth is a machine parameter used by pools (see (*B).Pool).
+// When a pool's machine fails because its disk is exhausted, the
+// pool's subsequent machines are started with a disk requirement
+// (see Resources) that is the provided factor times the larger of
+// the exhausted disk's size and the previous requirement.
+type DiskGrowth float64
+
+func (DiskGrowth) applyParam(*Machine) {}
+
+// growDisk returns the parameters params with their disk
+// requirement grown according to their DiskGrowth parameter, given
+// that a machine started with them exhausted a disk of the provided
+// size. It returns false if params do not include a DiskGrowth
+// parameter.
+func growDisk(params []Param, size data.Size) ([]Param, bool) {
+	var (
+		growth    DiskGrowth
+		resources Resources
+		grown     = make([]Param, 0, len(params)+1)
+	)
+	for _, p := range params {
+		switch p := p.(type) {
+		case DiskGrowth:
+			growth = p
+		case Resources:
+			resources = resources.Max(p)
+			continue
+		}
+		grown = append(grown, p)
+	}
+	if growth <= 0 {
+		return params, false
+	}
+	if size < resources.Disk {
+		size = resources.Disk
+	}
+	resources.Disk = data.Size(float64(size) * float64(growth))
+	return append(grown, resources), true
+}
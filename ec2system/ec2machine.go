@@ -51,6 +51,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/base/data"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/fatbin"
 	"github.com/grailbio/base/log"
@@ -352,7 +353,89 @@ func readSshAgentKeys() []string {
 // with the bigmachine command line and binary, as well as other
 // runtime information.
 func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, error) {
-	userData, err := s.cloudConfig().Marshal()
+	return s.start(ctx, count, s.shape())
+}
+
+// StartResources launches count new machines, as Start does, that
+// satisfy the provided resource requirements. If the system's
+// configured instance type satisfies them, it is used; otherwise the
+// cheapest instance type available in the system's region that does
+// is selected. Disk requirements are applied to the data volume if
+// one is configured, and to the root volume otherwise.
+func (s *System) StartResources(ctx context.Context, count int, r bigmachine.Resources) ([]*bigmachine.Machine, error) {
+	sh := s.shape()
+	if !satisfies(sh.config, r) {
+		typ, ok := cheapestType(*s.AWSConfig.Region, r)
+		if !ok {
+			return nil, errors.E(errors.NotExist, fmt.Sprintf("no instance type in region %s satisfies resources %+v", *s.AWSConfig.Region, r))
+		}
+		sh.config = typ
+	}
+	if r.Disk > 0 {
+		gib := uint((r.Disk + data.GiB - 1) / data.GiB)
+		if s.Dataspace > 0 {
+			if gib > sh.dataspace {
+				sh.dataspace = gib
+			}
+		} else if gib > sh.diskspace {
+			sh.diskspace = gib
+		}
+	}
+	return s.start(ctx, count, sh)
+}
+
+// Satisfies tells whether instance type typ satisfies the CPU,
+// memory, and CPU feature requirements in r.
+func satisfies(typ instances.Type, r bigmachine.Resources) bool {
+	if int(typ.VCPU) < r.CPUs {
+		return false
+	}
+	if float64(r.Memory) > typ.Memory*float64(data.GiB) {
+		return false
+	}
+	for _, feature := range r.CPUFeatures {
+		if !typ.CPUFeatures[feature] {
+			return false
+		}
+	}
+	return true
+}
+
+// CheapestType returns the cheapest instance type available in the
+// provided region that satisfies r. Current-generation instance
+// types are preferred over previous-generation ones of the same
+// price.
+func cheapestType(region string, r bigmachine.Resources) (typ instances.Type, ok bool) {
+	for _, t := range instances.Types {
+		price := t.Price[region]
+		if price == 0 || !satisfies(t, r) {
+			continue
+		}
+		if ok {
+			best := typ.Price[region]
+			if price > best || price == best && (typ.Generation == "current" || t.Generation != "current") {
+				continue
+			}
+		}
+		typ, ok = t, true
+	}
+	return
+}
+
+// A shape describes the instance type and storage configuration of
+// the machines launched by a system.
+type shape struct {
+	config               instances.Type
+	diskspace, dataspace uint
+}
+
+// Shape returns the system's configured machine shape.
+func (s *System) shape() shape {
+	return shape{s.config, s.Diskspace, s.Dataspace}
+}
+
+func (s *System) start(ctx context.Context, count int, sh shape) ([]*bigmachine.Machine, error) {
+	userData, err := s.cloudConfig(sh).Marshal()
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal cloud-config: %v", err)
 	}
@@ -389,12 +472,12 @@ func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, e
 			DeviceName: rootDeviceName,
 			Ebs: &ec2.EbsBlockDevice{
 				DeleteOnTermination: aws.Bool(true),
-				VolumeSize:          aws.Int64(int64(50 + s.Diskspace)),
+				VolumeSize:          aws.Int64(int64(50 + sh.diskspace)),
 				VolumeType:          aws.String("gp2"),
 			},
 		},
 	}
-	nslice, sliceSize := s.sliceConfig()
+	nslice, sliceSize := sh.sliceConfig()
 	for i := 0; i < nslice; i++ {
 		blockDevices = append(blockDevices, &ec2.BlockDeviceMapping{
 			// Device names are ignored for NVMe devices; they may be
@@ -433,12 +516,12 @@ func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, e
 				BlockDeviceMappings:   blockDevices,
 				DisableApiTermination: aws.Bool(false),
 				DryRun:                aws.Bool(false),
-				EbsOptimized:          aws.Bool(s.config.EBSOptimized),
+				EbsOptimized:          aws.Bool(sh.config.EBSOptimized),
 				IamInstanceProfile: &ec2.IamInstanceProfileSpecification{
 					Arn: aws.String(s.InstanceProfile),
 				},
 				InstanceInitiatedShutdownBehavior: aws.String("terminate"),
-				InstanceType:                      aws.String(s.config.Name),
+				InstanceType:                      aws.String(sh.config.Name),
 				Monitoring: &ec2.RunInstancesMonitoringEnabled{
 					Enabled: aws.Bool(true), // Required
 				},
@@ -464,13 +547,13 @@ func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, e
 		run = func() ([]string, error) {
 			resp, err := s.ec2.RequestSpotInstancesWithContext(ctx, &ec2.RequestSpotInstancesInput{
 				ValidUntil:    aws.Time(time.Now().Add(time.Minute)),
-				SpotPrice:     aws.String(fmt.Sprintf("%.3f", s.config.Price[*s.AWSConfig.Region])),
+				SpotPrice:     aws.String(fmt.Sprintf("%.3f", sh.config.Price[*s.AWSConfig.Region])),
 				InstanceCount: aws.Int64(int64(count)),
 				LaunchSpecification: &ec2.RequestSpotLaunchSpecification{
 					SubnetId:            aws.String(s.Subnet),
 					ImageId:             aws.String(s.AMI),
-					EbsOptimized:        aws.Bool(s.config.EBSOptimized),
-					InstanceType:        aws.String(s.config.Name),
+					EbsOptimized:        aws.Bool(sh.config.EBSOptimized),
+					InstanceType:        aws.String(sh.config.Name),
 					BlockDeviceMappings: blockDevices,
 					UserData:            aws.String(base64.StdEncoding.EncodeToString(userData)),
 					IamInstanceProfile: &ec2.IamInstanceProfileSpecification{
@@ -602,7 +685,7 @@ func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, e
 		}
 		machines[i] = new(bigmachine.Machine)
 		machines[i].Addr = fmt.Sprintf("https://%s/", addr)
-		machines[i].Maxprocs = int(s.config.VCPU)
+		machines[i].Maxprocs = int(sh.config.VCPU)
 	}
 	return machines, nil
 }
@@ -623,18 +706,23 @@ func getAddress(instance *ec2.Instance) string {
 }
 
 func (s *System) sliceConfig() (nslice int, sliceSize int64) {
+	return s.shape().sliceConfig()
+}
+
+func (sh shape) sliceConfig() (nslice int, sliceSize int64) {
 	sliceSize = minDataVolumeSliceSize
-	nslice = int((int64(s.Dataspace) + sliceSize - 1) / sliceSize)
+	nslice = int((int64(sh.dataspace) + sliceSize - 1) / sliceSize)
 	if nslice <= maxInstanceDataVolumes {
 		return
 	}
 	nslice = maxInstanceDataVolumes
-	sliceSize = int64(s.Dataspace) / int64(nslice)
+	sliceSize = int64(sh.dataspace) / int64(nslice)
 	return
 }
 
-// CloudConfig returns the cloudConfig instance as configured by the current system.
-func (s *System) cloudConfig() *cloudConfig {
+// CloudConfig returns the cloudConfig instance as configured by the
+// current system for machines of the provided shape.
+func (s *System) cloudConfig(sh shape) *cloudConfig {
 	c := new(cloudConfig)
 	c.SshAuthorizedKeys = s.SshKeys
 	c.Flavor = s.Flavor
@@ -656,12 +744,12 @@ func (s *System) cloudConfig() *cloudConfig {
 		// Devices is all the devices used to compose storage.
 		devices []string
 	)
-	switch nslice, _ := s.sliceConfig(); nslice {
+	switch nslice, _ := sh.sliceConfig(); nslice {
 	case 0:
 	case 1:
 		// No need to set up striping in this case.
 		dataDeviceName = "xvdb"
-		if s.config.NVMe {
+		if sh.config.NVMe {
 			dataDeviceName = "nvme1n1"
 		}
 		c.AppendUnit(CloudUnit{
@@ -684,7 +772,7 @@ func (s *System) cloudConfig() *cloudConfig {
 		devices = make([]string, nslice)
 		// Remap names for NVMe instances.
 		for idx := range devices {
-			if s.config.NVMe {
+			if sh.config.NVMe {
 				devices[idx] = fmt.Sprintf("nvme%dn1", idx+1)
 			} else {
 				devices[idx] = fmt.Sprintf("xvd%c", 'b'+idx)
@@ -844,6 +932,28 @@ func (s *System) cloudConfig() *cloudConfig {
 
 const httpTimeout = 30 * time.Second
 
+// SessionState returns the system's authority, so that a restarted
+// driver may communicate with the machines started by its
+// predecessor.
+func (s *System) SessionState() ([]byte, error) {
+	return s.authorityContents, nil
+}
+
+// RestoreSession replaces the system's authority with the one saved
+// in the provided session state.
+func (s *System) RestoreSession(state []byte) error {
+	if err := ioutil.WriteFile(authorityPath, state, 0600); err != nil {
+		return err
+	}
+	var err error
+	s.authority, err = authority.New(authorityPath)
+	if err != nil {
+		return err
+	}
+	s.authorityContents = state
+	return nil
+}
+
 // HTTPClient returns an HTTP client configured to securely call
 // instances launched by ec2machine over http/2.
 func (s *System) HTTPClient() *http.Client {
@@ -899,9 +1009,23 @@ func (s *System) ListenAndServe(addr string, handler http.Handler) error {
 	return server.ListenAndServeTLS("", "")
 }
 
-// Exit terminates the process with the given exit code.
+// stoppedExitCode is the exit code with which machines exit when
+// they are asked to exit successfully.
+const stoppedExitCode = 2
+
+// osExit is the function used to terminate the process; it is
+// replaced in tests.
+var osExit = os.Exit
+
+// Exit terminates the process with the given exit code. The
+// bootmachine unit powers off the instance, releasing it, only if
+// the process fails; thus Exit never exits successfully: code 0 is
+// replaced by stoppedExitCode.
 func (s *System) Exit(code int) {
-	os.Exit(code)
+	if code == 0 {
+		code = stoppedExitCode
+	}
+	osExit(code)
 }
 
 func (s *System) Tail(ctx context.Context, m *bigmachine.Machine) (io.Reader, error) {
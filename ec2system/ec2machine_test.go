@@ -13,6 +13,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/bigmachine"
+	"github.com/grailbio/bigmachine/ec2system/instances"
 	"github.com/grailbio/bigmachine/internal/authority"
 	"github.com/grailbio/testutil"
 	"golang.org/x/net/http2"
@@ -40,6 +43,33 @@ func TestDiskConfig(t *testing.T) {
 	}
 }
 
+func TestCheapestType(t *testing.T) {
+	const region = "us-west-2"
+	for _, r := range []bigmachine.Resources{
+		{CPUs: 1},
+		{CPUs: 8, Memory: 30 * data.GiB},
+		{Memory: 100 * data.GiB},
+		{CPUs: 4, CPUFeatures: []string{"intel_avx2"}},
+	} {
+		typ, ok := cheapestType(region, r)
+		if !ok {
+			t.Errorf("%+v: no type found", r)
+			continue
+		}
+		if !satisfies(typ, r) {
+			t.Errorf("%+v: type %s does not satisfy resources", r, typ.Name)
+		}
+		for _, other := range instances.Types {
+			if price := other.Price[region]; price > 0 && price < typ.Price[region] && satisfies(other, r) {
+				t.Errorf("%+v: type %s is cheaper than %s", r, other.Name, typ.Name)
+			}
+		}
+	}
+	if _, ok := cheapestType(region, bigmachine.Resources{CPUs: 1 << 20}); ok {
+		t.Error("expected no type")
+	}
+}
+
 func TestMutualHTTPS(t *testing.T) {
 	// This is a really nasty way of testing what's going on here,
 	// but we do want to test this property end-to-end.
@@ -99,3 +129,29 @@ func getFreeTCPPort() (int, error) {
 	l.Close()
 	return port, nil
 }
+
+// TestExit verifies that machines always exit unsuccessfully, so
+// that their instances are powered off by the bootmachine unit.
+func TestExit(t *testing.T) {
+	save := osExit
+	defer func() { osExit = save }()
+	var code int
+	osExit = func(c int) { code = c }
+	sys := new(System)
+	for _, c := range []struct{ code, want int }{
+		{0, stoppedExitCode},
+		{1, 1},
+	} {
+		sys.Exit(c.code)
+		if got, want := code, c.want; got != want {
+			t.Errorf("exit(%d): got %v, want %v", c.code, got, want)
+		}
+	}
+	out, err := sys.cloudConfig(sys.shape()).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "OnFailure=poweroff.target") {
+		t.Error("bootmachine does not power off on failure")
+	}
+}
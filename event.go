@@ -0,0 +1,178 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// An EventKind is the kind of a machine lifecycle event.
+type EventKind int
+
+const (
+	// EventStarting indicates that the machine is bootstrapping.
+	EventStarting EventKind = iota
+	// EventRunning indicates that the machine is running and ready
+	// to receive calls.
+	EventRunning
+	// EventStopped indicates that the machine has stopped. The
+	// event's error is the machine's error.
+	EventStopped
+	// EventKeepaliveSlow indicates that a keepalive reply took
+	// unusually long. The event's latency is the reply time.
+	EventKeepaliveSlow
+	// EventUnhealthy indicates that the machine's supervisor
+	// replied to a keepalive indicating that the machine is
+	// unhealthy. It is published when the machine becomes
+	// unhealthy, and again only if the reason changes.
+	EventUnhealthy
+	// EventOOM indicates that the machine's process (or, on
+	// systems with cgroup v2, another process in the machine's
+	// cgroup) was killed because the machine ran out of memory.
+	EventOOM
+	// EventDiskFull indicates that one of the machine's disks was
+	// exhausted. The event's reason describes the disk. The machine
+	// is subsequently stopped with ErrDiskFull.
+	EventDiskFull
+	// EventMemoryPressure indicates that the processes in the
+	// machine's cgroup are stalled on memory, and that an OOM kill
+	// may be imminent. The event's reason describes the pressure.
+	EventMemoryPressure
+)
+
+// String returns a human-readable name for the event kind.
+func (k EventKind) String() string {
+	switch k {
+	case EventStarting:
+		return "STARTING"
+	case EventRunning:
+		return "RUNNING"
+	case EventStopped:
+		return "STOPPED"
+	case EventKeepaliveSlow:
+		return "KEEPALIVE_SLOW"
+	case EventUnhealthy:
+		return "UNHEALTHY"
+	case EventOOM:
+		return "OOM"
+	case EventDiskFull:
+		return "DISK_FULL"
+	case EventMemoryPressure:
+		return "MEMORY_PRESSURE"
+	default:
+		panic(fmt.Sprintf("invalid event kind %d", k))
+	}
+}
+
+// An Event describes a change in a machine's lifecycle.
+type Event struct {
+	// Kind is the kind of event.
+	Kind EventKind
+	// Machine is the machine to which the event pertains.
+	Machine *Machine
+	// Time is the time at which the event occurred.
+	Time time.Time
+	// Err is the error associated with the event, if any.
+	Err error
+	// Latency is the keepalive reply time for EventKeepaliveSlow
+	// events.
+	Latency time.Duration
+	// Reason describes why the machine is unhealthy for
+	// EventUnhealthy events, the exhausted disk for EventDiskFull
+	// events, and the memory pressure for EventMemoryPressure
+	// events.
+	Reason string
+}
+
+// String returns a human-readable description of the event.
+func (e Event) String() string {
+	s := fmt.Sprintf("%s %s", e.Machine.Addr, e.Kind)
+	if e.Err != nil {
+		s += fmt.Sprintf(" (%v)", e.Err)
+	}
+	if e.Latency > 0 {
+		s += fmt.Sprintf(" (latency %s)", e.Latency)
+	}
+	if e.Reason != "" {
+		s += fmt.Sprintf(" (%s)", e.Reason)
+	}
+	return s
+}
+
+// An eventSubscriber buffers events for a single subscriber, so
+// that machines never block on slow subscribers.
+type eventSubscriber struct {
+	mu     sync.Mutex
+	queue  []Event
+	notify chan struct{}
+}
+
+func (s *eventSubscriber) publish(e Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *eventSubscriber) loop(ctx context.Context, c chan<- Event) {
+	defer close(c)
+	for {
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return
+		}
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, e := range queue {
+			select {
+			case c <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Events returns a channel of lifecycle events for all of the
+// machines known to this B (whether started or dialed), beginning
+// with those that occur after the call to Events. Events are buffered
+// so that slow receivers do not hold up the machines; they are
+// delivered in the order in which they occurred. The channel is
+// closed when the provided context is done.
+func (b *B) Events(ctx context.Context) <-chan Event {
+	s := &eventSubscriber{notify: make(chan struct{}, 1)}
+	b.eventMu.Lock()
+	b.subscribers[s] = true
+	b.eventMu.Unlock()
+	c := make(chan Event)
+	go func() {
+		s.loop(ctx, c)
+		b.eventMu.Lock()
+		delete(b.subscribers, s)
+		b.eventMu.Unlock()
+	}()
+	return c
+}
+
+// publish delivers an event to all of b's subscribers.
+func (b *B) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.eventMu.Lock()
+	defer b.eventMu.Unlock()
+	for s := range b.subscribers {
+		s.publish(e)
+	}
+}
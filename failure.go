@@ -0,0 +1,139 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// A FailureKind classifies the cause of a machine's failure.
+type FailureKind int
+
+const (
+	// FailureNone indicates that the machine has not failed.
+	FailureNone FailureKind = iota
+	// FailureOther indicates a failure of unknown cause, for
+	// example a lost keepalive.
+	FailureOther
+	// FailureCanceled indicates that the machine was canceled or
+	// stopped by the driver.
+	FailureCanceled
+	// FailureOOM indicates that the machine's process was killed
+	// because the machine ran out of memory.
+	FailureOOM
+	// FailureDiskFull indicates that one of the machine's disks was
+	// exhausted.
+	FailureDiskFull
+	// FailureUnhealthy indicates that the machine was stopped
+	// because it was unhealthy. See UnhealthyStop.
+	FailureUnhealthy
+	// FailureInstanceMismatch indicates that the machine's address
+	// was served by a different instance.
+	FailureInstanceMismatch
+)
+
+// String returns a human-readable name for the failure kind.
+func (k FailureKind) String() string {
+	switch k {
+	case FailureNone:
+		return "NONE"
+	case FailureOther:
+		return "OTHER"
+	case FailureCanceled:
+		return "CANCELED"
+	case FailureOOM:
+		return "OOM"
+	case FailureDiskFull:
+		return "DISK_FULL"
+	case FailureUnhealthy:
+		return "UNHEALTHY"
+	case FailureInstanceMismatch:
+		return "INSTANCE_MISMATCH"
+	default:
+		panic(fmt.Sprintf("invalid failure kind %d", k))
+	}
+}
+
+// Failure classifies the cause of the machine's failure. Like Err,
+// Failure is only well-defined when the machine is in Stopped state.
+func (m *Machine) Failure() FailureKind {
+	if m.dialed != nil {
+		if m.handleCtx.Err() != nil {
+			return FailureCanceled
+		}
+		return m.dialed.Failure()
+	}
+	m.mu.Lock()
+	kind, err, canceled := m.failure, m.err, m.canceled
+	m.mu.Unlock()
+	switch {
+	case kind != FailureNone:
+		return kind
+	case err == nil:
+		return FailureNone
+	case err == ErrInstanceMismatch:
+		return FailureInstanceMismatch
+	case canceled, err == context.Canceled:
+		return FailureCanceled
+	case errors.Is(errors.OOM, err):
+		return FailureOOM
+	default:
+		return FailureOther
+	}
+}
+
+// markCanceled records that the machine is canceled or stopped by
+// the driver, so that the resulting failure is classified as
+// FailureCanceled regardless of the error with which the machine is
+// stopped (e.g., a failed keepalive of the exiting machine). It must
+// be called before the machine's context is canceled. Machines that
+// have already failed retain their classification.
+func (m *Machine) markCanceled() {
+	m.mu.Lock()
+	if m.err == nil {
+		m.canceled = true
+	}
+	m.mu.Unlock()
+}
+
+// fail fails the machine with the provided error, classified by
+// the provided kind. Machines canceled by the driver remain
+// classified as FailureCanceled.
+func (m *Machine) fail(kind FailureKind, err error) {
+	m.mu.Lock()
+	if m.err == nil && !m.canceled {
+		m.failure = kind
+	}
+	m.mu.Unlock()
+	m.setError(err)
+}
+
+// failedStopTimeout is the amount of time given to a failed
+// machine's process to stop.
+const failedStopTimeout = 30 * time.Second
+
+// stopFailed fails a machine that the driver has determined to have
+// failed, and then stops its process in the background. The
+// process's pending calls are not drained: they are unlikely to
+// complete (e.g., because the machine's disk is exhausted), and are
+// canceled by the failure in any case.
+func (m *Machine) stopFailed(kind FailureKind, err error) {
+	m.fail(kind, err)
+	if !m.owner {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), failedStopTimeout)
+		defer cancel()
+		if err := m.call(ctx, "Supervisor.Stop", time.Duration(0), nil); err != nil {
+			log.Error.Printf("%s: stop: %v", m.Addr, err)
+		}
+	}()
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/errors"
+)
+
+// A File is a file that is staged onto a machine before its
+// services are registered.
+type File struct {
+	// Name is the name of the file on the machine, relative to the
+	// machine's file directory (see (*B).FileDir). It may contain
+	// subdirectories.
+	Name string
+	// Path is the local path of the file's contents.
+	Path string
+	// Open, if provided, opens the file's contents instead of
+	// Path. It is called once for each machine onto which the file
+	// is staged.
+	Open func() (io.ReadCloser, error)
+}
+
+// Files is a machine parameter that stages the provided files onto
+// the machine before its services are registered, so that they are
+// available to the services' Init methods. The files' contents are
+// streamed to the machine, and their checksums are verified before
+// they are placed in the machine's file directory. Multiple Files
+// parameters may be passed.
+type Files []File
+
+func (f Files) applyParam(m *Machine) {
+	m.files = append(m.files, f...)
+}
+
+func (f File) open() (io.ReadCloser, error) {
+	if f.Open != nil {
+		return f.Open()
+	}
+	return os.Open(f.Path)
+}
+
+// FileDir returns the directory in which files staged by a Files
+// parameter are placed on this machine.
+func (b *B) FileDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("bigmachine-files-%d-%d", os.Getpid(), b.index))
+}
+
+// A stagedFile describes a file that has been staged by
+// Supervisor.StageFile but not yet committed.
+type stagedFile struct {
+	// Token identifies the staged file.
+	Token string
+	// Digest is the digest of the staged file's contents.
+	Digest digest.Digest
+}
+
+// A commitFile is a request to commit a staged file.
+type commitFile struct {
+	// Token identifies the staged file, as returned by
+	// Supervisor.StageFile.
+	Token string
+	// Name is the name of the file in the machine's file
+	// directory.
+	Name string
+}
+
+// stageFile streams file f to machine m, verifying its checksum
+// before committing it to the machine's file directory.
+func (m *Machine) stageFile(ctx context.Context, f File) error {
+	rc, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dw := digester.NewWriter()
+	var staged stagedFile
+	if err := m.call(ctx, "Supervisor.StageFile", io.TeeReader(rc, dw), &staged); err != nil {
+		return err
+	}
+	if got, want := staged.Digest, dw.Digest(); got != want {
+		return errors.E(errors.Integrity, fmt.Sprintf("staged file %s: digest mismatch: got %v, want %v", f.Name, got, want))
+	}
+	return m.call(ctx, "Supervisor.CommitFile", commitFile{staged.Token, f.Name}, nil)
+}
+
+// validFileName tells whether name names a file inside of a
+// machine's file directory.
+func validFileName(name string) bool {
+	if name == "" || filepath.IsAbs(name) {
+		return false
+	}
+	name = filepath.Clean(name)
+	return name != "." && name != ".." && !strings.HasPrefix(name, ".."+string(filepath.Separator))
+}
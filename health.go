@@ -0,0 +1,216 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/log"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
+)
+
+const (
+	// healthCheckPeriod is the period at which supervisors check
+	// their machine's health.
+	healthCheckPeriod = time.Minute
+	// healthCheckTimeout is the amount of time a service's health
+	// check is given to complete.
+	healthCheckTimeout = 30 * time.Second
+	// defaultMemoryThreshold is the default percentage of system
+	// memory above which a machine is considered unhealthy.
+	defaultMemoryThreshold = 95
+)
+
+// HealthThresholds is a machine parameter that configures the
+// thresholds above which a machine's supervisor reports the machine
+// as unhealthy. A zero threshold leaves the corresponding check at
+// its default: the memory check defaults to 95%; the disk and load
+// checks are disabled by default.
+//
+// Disk thresholds apply to the disk holding the temporary directory
+// (as reported by (*Machine).DiskInfo) and to the disks holding the
+// configured data paths. Regardless of thresholds, a machine fails
+// with ErrDiskFull if any of these disks is exhausted.
+type HealthThresholds struct {
+	// MemoryPercent is the percentage of system memory in use.
+	MemoryPercent float64
+	// DiskPercent is the percentage of a disk in use.
+	DiskPercent float64
+	// DiskFree is the amount of free space on a disk below which
+	// the machine is unhealthy.
+	DiskFree data.Size
+	// Load is the 1-minute load average per CPU.
+	Load float64
+	// MemoryPressure is the percentage of time, averaged over 10
+	// seconds, during which all of the processes in the machine's
+	// cgroup may be stalled on memory before memory pressure is
+	// reported (see EventMemoryPressure). It defaults to 10%. Memory
+	// pressure is monitored only on systems with cgroup v2.
+	MemoryPressure float64
+	// DataPaths are additional paths whose disks are monitored.
+	DataPaths []string
+}
+
+func (h HealthThresholds) applyParam(m *Machine) {
+	m.healthThresholds = &h
+}
+
+// An UnhealthyAction is a machine parameter that determines what is
+// done with the machine when its supervisor reports that it is
+// unhealthy.
+type UnhealthyAction int
+
+const (
+	// UnhealthyProfile captures diagnostics from an unhealthy
+	// machine (see Diagnostics), but otherwise leaves it alone. This
+	// is the default.
+	UnhealthyProfile UnhealthyAction = iota
+	// UnhealthyCordon cordons the machine while it is unhealthy:
+	// it remains running, but it is not returned by (*Pool).Machines.
+	// The machine is uncordoned if it becomes healthy again.
+	UnhealthyCordon
+	// UnhealthyStop stops an unhealthy machine. The machine fails
+	// with an errors.Unavailable error describing its health.
+	UnhealthyStop
+)
+
+func (a UnhealthyAction) applyParam(m *Machine) {
+	m.unhealthyAction = a
+}
+
+// Unhealthy returns a description of why the machine's supervisor
+// last reported the machine as unhealthy, or an empty string if the
+// machine is healthy.
+func (m *Machine) Unhealthy() string {
+	if m.dialed != nil {
+		return m.dialed.Unhealthy()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.unhealthy
+}
+
+// Cordoned tells whether the machine is cordoned. See UnhealthyCordon.
+func (m *Machine) Cordoned() bool {
+	if m.dialed != nil {
+		return m.dialed.Cordoned()
+	}
+	return m.unhealthyAction == UnhealthyCordon && m.Unhealthy() != ""
+}
+
+// A healthChecker is a service that reports its own health. Services
+// with a Health method are checked periodically by the supervisor; an
+// error marks the machine unhealthy.
+type healthChecker interface {
+	Health(context.Context) error
+}
+
+// SetHealthThresholds sets the thresholds used by the supervisor to
+// determine the machine's health.
+func (s *Supervisor) SetHealthThresholds(ctx context.Context, thresholds HealthThresholds, _ *struct{}) error {
+	s.mu.Lock()
+	s.thresholds = thresholds
+	s.mu.Unlock()
+	s.checkHealthNow()
+	return nil
+}
+
+// checkHealthNow requests an immediate health check.
+func (s *Supervisor) checkHealthNow() {
+	select {
+	case s.checkc <- struct{}{}:
+	default:
+	}
+}
+
+// healthcheck periodically checks the machine's health until the
+// provided context is done. Health is checked in its own routine,
+// so that slow checks do not hold up keepalives.
+func (s *Supervisor) healthcheck(ctx context.Context) {
+	tick := time.NewTicker(healthCheckPeriod)
+	defer tick.Stop()
+	for {
+		reason := s.checkHealth(ctx)
+		s.mu.Lock()
+		if reason != "" && reason != s.unhealthy {
+			log.Error.Printf("marking machine unhealthy: %s", reason)
+		}
+		s.unhealthy = reason
+		s.mu.Unlock()
+		select {
+		case <-tick.C:
+		case <-s.checkc:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkHealth checks the machine's system resources against the
+// configured thresholds, and runs the health checks of registered
+// services. It returns a description of the machine's problems, or
+// an empty string if the machine is healthy. Checks that cannot be
+// performed do not affect the machine's health.
+func (s *Supervisor) checkHealth(ctx context.Context) string {
+	s.mu.Lock()
+	thresholds := s.thresholds
+	names := make([]string, 0, len(s.checks))
+	checks := make(map[string]healthChecker, len(s.checks))
+	for name, c := range s.checks {
+		names = append(names, name)
+		checks[name] = c
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+	if thresholds.MemoryPercent == 0 {
+		thresholds.MemoryPercent = defaultMemoryThreshold
+	}
+
+	var reasons []string
+	if vm, err := mem.VirtualMemory(); err != nil {
+		log.Error.Printf("failed to retrieve VM stats: %v", err)
+	} else if vm.UsedPercent > thresholds.MemoryPercent {
+		reasons = append(reasons, fmt.Sprintf("using %.1f%% of system memory", vm.UsedPercent))
+	}
+	if thresholds.DiskPercent > 0 || thresholds.DiskFree > 0 {
+		for _, path := range s.diskPaths() {
+			usage, err := disk.Usage(path)
+			if err != nil {
+				log.Error.Printf("failed to retrieve disk usage for %s: %v", path, err)
+				continue
+			}
+			switch {
+			case thresholds.DiskPercent > 0 && usage.UsedPercent > thresholds.DiskPercent:
+				reasons = append(reasons, fmt.Sprintf("%s: using %.1f%% of disk", path, usage.UsedPercent))
+			case thresholds.DiskFree > 0 && data.Size(usage.Free) < thresholds.DiskFree:
+				reasons = append(reasons, fmt.Sprintf("%s: %s of disk free", path, data.Size(usage.Free)))
+			}
+		}
+	}
+	if thresholds.Load > 0 {
+		if avg, err := load.AvgWithContext(ctx); err != nil {
+			log.Error.Printf("failed to retrieve load average: %v", err)
+		} else if l := avg.Load1 / float64(runtime.NumCPU()); l > thresholds.Load {
+			reasons = append(reasons, fmt.Sprintf("load %.1f per CPU", l))
+		}
+	}
+	for _, name := range names {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := checks[name].Health(checkCtx)
+		cancel()
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("service %s: %v", name, err))
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
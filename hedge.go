@@ -0,0 +1,125 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine/rpc"
+)
+
+// defaultHedgePercentile is the latency percentile after which a
+// hedged call is sent to the next machine.
+const defaultHedgePercentile = 0.95
+
+// defaultHedgeDelay is the hedging delay used when too few calls have
+// been observed to estimate a latency percentile.
+const defaultHedgeDelay = 100 * time.Millisecond
+
+// A HedgeOption configures a hedged call; see (*B).HedgedCall.
+type HedgeOption func(*hedgeConfig)
+
+type hedgeConfig struct {
+	percentile float64
+	delay      time.Duration
+}
+
+// HedgePercentile sets the latency percentile (0 < p < 1) of
+// previously observed calls to the same method after which a hedged
+// call is sent to the next machine. The default is 0.95.
+func HedgePercentile(p float64) HedgeOption {
+	return func(c *hedgeConfig) {
+		c.percentile = p
+	}
+}
+
+// HedgeDelay sets the delay after which a hedged call is sent to the
+// next machine when too few calls to the method have been observed to
+// estimate its latency percentile. The default is 100ms.
+func HedgeDelay(d time.Duration) HedgeOption {
+	return func(c *hedgeConfig) {
+		c.delay = d
+	}
+}
+
+// HedgedCall invokes the provided service method on the first of the
+// provided machines. If the call has not completed within a latency
+// percentile of previously observed calls to the same method (see
+// HedgePercentile and HedgeDelay), a duplicate call is made to the
+// next machine, and so on, until every machine has been called. A
+// call that fails also causes the next machine to be called
+// immediately. The first successful reply is stored in reply, and
+// the remaining calls are canceled. HedgedCall fails only if every
+// call fails, in which case it returns the last error.
+//
+// Because the same call may be executed by several machines,
+// HedgedCall should be used only with idempotent methods. The reply
+// must be a pointer.
+func (b *B) HedgedCall(ctx context.Context, machines []*Machine, serviceMethod string, arg, reply interface{}, opts ...HedgeOption) error {
+	if len(machines) == 0 {
+		return errors.E(errors.Invalid, "hedged call: no machines")
+	}
+	replyv := reflect.ValueOf(reply)
+	if replyv.Kind() != reflect.Ptr || replyv.IsNil() {
+		return errors.E(errors.Invalid, fmt.Sprintf("hedged call: reply type %T is not a pointer", reply))
+	}
+	config := hedgeConfig{percentile: defaultHedgePercentile, delay: defaultHedgeDelay}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	delay := config.delay
+	if d, ok := rpc.Latency(serviceMethod, config.percentile); ok {
+		delay = d
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		reply reflect.Value
+		err   error
+	}
+	// Each call is given its own reply so that losing calls do not
+	// race with the winner.
+	results := make(chan result, len(machines))
+	call := func(m *Machine) {
+		r := reflect.New(replyv.Type().Elem())
+		results <- result{r, m.Call(ctx, serviceMethod, arg, r.Interface())}
+	}
+	go call(machines[0])
+	var (
+		next    = 1
+		pending = 1
+		timer   = time.NewTimer(delay)
+		err     error
+	)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(machines) {
+				go call(machines[next])
+				next++
+				pending++
+				timer.Reset(delay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				replyv.Elem().Set(r.reply.Elem())
+				return nil
+			}
+			err = r.err
+			if next < len(machines) {
+				go call(machines[next])
+				next++
+				pending++
+			}
+		}
+	}
+	return err
+}
@@ -14,24 +14,37 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"runtime"
 	"sync"
 	"time"
 
 	"github.com/grailbio/base/config"
+	"github.com/grailbio/base/data"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/iofmt"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/bigmachine/internal/authority"
 	bigioutil "github.com/grailbio/bigmachine/internal/ioutil"
 	"github.com/grailbio/bigmachine/internal/tee"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/mem"
 	"golang.org/x/net/http2"
 )
 
 func init() {
 	config.Register("bigmachine/local", func(constr *config.Constructor) {
+		var config LocalConfig
+		constr.StringVar(&config.Cgroup, "cgroup", "",
+			"a delegated cgroup v2 directory in which each local machine is given its own cgroup; empty disables isolation")
+		constr.IntVar(&config.CPUs, "cpus", 0, "the number of CPUs available to each local machine; 0 is unlimited")
+		memory := constr.Int("memory", 0, "the amount of memory (in MiB) available to each local machine; 0 is unlimited")
 		constr.Doc = "bigmachine/local is the bigmachine instance used for local process-based clusters"
 		constr.New = func() (interface{}, error) {
-			return Local, nil
+			config.Memory = data.Size(*memory) * data.MiB
+			if config == (LocalConfig{}) {
+				return Local, nil
+			}
+			return NewLocal(config), nil
 		}
 	})
 
@@ -43,14 +56,45 @@ func init() {
 const maxConcurrentStreams = 20000
 const httpTimeout = 30 * time.Second
 
+// oomStartTimeout is the amount of time for which a machine whose
+// process was killed by the OOM killer is awaited to start before it
+// can be failed. Machines that are not started by then, or by the
+// time their start context is done (e.g., because they were rejected
+// by B.Start), are not failed.
+const oomStartTimeout = time.Minute
+
 // Local is a System that insantiates machines by
 // creating new processes on the local machine.
 var Local System = new(localSystem)
 
+// LocalConfig configures the resources of the machines started by a
+// local system.
+type LocalConfig struct {
+	// Cgroup is the directory of a cgroup v2 group, delegated to the
+	// user and without processes of its own, in which each machine is
+	// given its own group. The CPU and memory limits are enforced
+	// only if Cgroup is set, and OOM kills within a machine's group
+	// fail the machine.
+	Cgroup string
+	// CPUs is the number of CPUs available to each machine. It is
+	// reported as the machine's Maxprocs.
+	CPUs int
+	// Memory is the amount of memory available to each machine.
+	Memory data.Size
+}
+
+// NewLocal returns a local system whose machines are configured by
+// the provided configuration. Resources requested when starting
+// machines (see Resources) take precedence over the configuration.
+func NewLocal(config LocalConfig) System {
+	return &localSystem{config: config}
+}
+
 // LocalSystem implements a System that instantiates machines
 // by creating processes on the local machine.
 type localSystem struct {
 	Gobable           struct{} // to make the struct gob-encodable
+	config            LocalConfig
 	authorityFilename string
 	authority         *authority.T
 
@@ -73,44 +117,172 @@ func (s *localSystem) Init(_ *B) error {
 	return err
 }
 
+// SessionState returns the local system's authority, so that a
+// restarted driver may communicate with the machines started by its
+// predecessor.
+func (s *localSystem) SessionState() ([]byte, error) {
+	return ioutil.ReadFile(s.authorityFilename)
+}
+
+// RestoreSession replaces the local system's authority with the one
+// saved in the provided session state.
+func (s *localSystem) RestoreSession(state []byte) error {
+	if err := ioutil.WriteFile(s.authorityFilename, state, 0600); err != nil {
+		return err
+	}
+	var err error
+	s.authority, err = authority.New(s.authorityFilename)
+	return err
+}
+
 func (*localSystem) Name() string {
 	return "local"
 }
 
 func (s *localSystem) Start(ctx context.Context, count int) ([]*Machine, error) {
+	return s.start(ctx, count, s.config.CPUs, s.config.Memory)
+}
+
+// StartResources starts count new local machines, each of which is
+// given the requested number of processors and amount of memory.
+// StartResources fails if the local machine itself cannot satisfy
+// the requested resources.
+func (s *localSystem) StartResources(ctx context.Context, count int, r Resources) ([]*Machine, error) {
+	if r.CPUs > runtime.NumCPU() {
+		return nil, errors.E(errors.Unavailable, fmt.Sprintf("requested %d CPUs, but only %d are available", r.CPUs, runtime.NumCPU()))
+	}
+	if r.Memory > 0 {
+		vm, err := mem.VirtualMemory()
+		if err != nil {
+			return nil, err
+		}
+		if total := data.Size(vm.Total); r.Memory > total {
+			return nil, errors.E(errors.Unavailable, fmt.Sprintf("requested %s of memory, but only %s is available", r.Memory, total))
+		}
+	}
+	if r.Disk > 0 {
+		usage, err := disk.Usage(os.TempDir())
+		if err != nil {
+			return nil, err
+		}
+		if free := data.Size(usage.Free); r.Disk > free {
+			return nil, errors.E(errors.Unavailable, fmt.Sprintf("requested %s of disk, but only %s is free", r.Disk, free))
+		}
+	}
+	if len(r.CPUFeatures) > 0 {
+		return nil, errors.E(errors.NotSupported, "CPU features cannot be requested from the local system")
+	}
+	cpus, memory := r.CPUs, r.Memory
+	if cpus == 0 {
+		cpus = s.config.CPUs
+	}
+	if memory == 0 {
+		memory = s.config.Memory
+	}
+	return s.start(ctx, count, cpus, memory)
+}
+
+// start starts count local machines, each limited to the provided
+// number of CPUs and amount of memory. Zero values impose no limits;
+// machines without a CPU limit report a Maxprocs of 1.
+func (s *localSystem) start(ctx context.Context, count, cpus int, memory data.Size) ([]*Machine, error) {
 	machines := make([]*Machine, count)
 	for i := range machines {
 		port, err := getFreeTCPPort()
 		if err != nil {
 			return nil, err
 		}
+		m := new(Machine)
+		m.Addr = fmt.Sprintf("https://localhost:%d/", port)
+		m.Maxprocs = cpus
+		if m.Maxprocs == 0 {
+			m.Maxprocs = 1
+		}
 		prefix := fmt.Sprintf("localhost:%d: ", port)
 		cmd := exec.Command(os.Args[0], os.Args[1:]...)
 		cmd.Env = os.Environ()
 		cmd.Env = append(cmd.Env, "BIGMACHINE_MODE=machine")
 		cmd.Env = append(cmd.Env, "BIGMACHINE_SYSTEM=local")
+		if cpus > 0 {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("GOMAXPROCS=%d", cpus))
+		}
 		muxer := new(tee.Writer)
 		s.mu.Lock()
-		s.muxers[machines[i]] = muxer
+		s.muxers[m] = muxer
 		s.mu.Unlock()
 		cmd.Stdout = iofmt.PrefixWriter(muxer, prefix)
 		cmd.Stderr = iofmt.PrefixWriter(muxer, prefix)
 		cmd.Env = append(cmd.Env, fmt.Sprintf("BIGMACHINE_ADDR=:%d", port))
 		cmd.Env = append(cmd.Env, fmt.Sprintf("BIGMACHINE_AUTHORITY=%s", s.authorityFilename))
-
-		m := new(Machine)
-		m.Addr = fmt.Sprintf("https://localhost:%d/", port)
-		m.Maxprocs = 1
+		// The memory events of the machine's cgroup tell us whether
+		// its process is killed by the OOM killer. Unless the machine
+		// is isolated in its own cgroup, it shares ours.
+		var (
+			cgroup   string
+			events   memoryEvents
+			isolated = s.config.Cgroup != ""
+		)
+		if isolated {
+			cgroup, err = createCgroup(s.config.Cgroup, fmt.Sprintf("bigmachine-%d-%d", os.Getpid(), port), cpus, memory)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			cgroup, err = cgroupDir("self")
+			if err == nil {
+				events, err = readMemoryEvents(cgroup)
+			}
+			if err != nil {
+				log.Debug.Printf("machine %s: not monitoring for OOMs: %v", m.Addr, err)
+				cgroup = ""
+			}
+		}
 		err = cmd.Start()
+		if err == nil && isolated {
+			// The process briefly runs outside of its cgroup, before
+			// it has initialized.
+			if err = addToCgroup(cgroup, cmd.Process.Pid); err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+			}
+		}
 		if err != nil {
+			if isolated {
+				os.Remove(cgroup)
+			}
 			return nil, err
 		}
+		addr := m.Addr
 		go func() {
 			if err := cmd.Wait(); err != nil {
-				log.Printf("machine %s terminated with error: %v", m.Addr, err)
+				log.Printf("machine %s terminated with error: %v", addr, err)
 			} else {
-				log.Printf("machine %s terminated", m.Addr)
+				log.Printf("machine %s terminated", addr)
+			}
+			oom := oomKilled(cmd.ProcessState, cgroup, events)
+			if isolated {
+				if err := os.Remove(cgroup); err != nil {
+					log.Error.Printf("machine %s: remove cgroup: %v", addr, err)
+				}
+			}
+			if !oom {
+				return
 			}
+			// The machine must be started before it can be failed. It
+			// may never be, if it is rejected by B.Start.
+			select {
+			case <-m.Wait(Starting):
+			case <-ctx.Done():
+			case <-time.After(oomStartTimeout):
+			}
+			if m.State() < Starting {
+				log.Error.Printf("machine %s: killed by the kernel before it was started", addr)
+				return
+			}
+			err := errors.E(errors.OOM, "bigmachine process killed by the kernel")
+			m.event(Event{Kind: EventOOM, Err: err})
+			m.fail(FailureOOM, err)
+			m.Cancel()
 		}()
 		machines[i] = m
 	}
@@ -171,7 +343,12 @@ func (*localSystem) Exit(code int) {
 
 func (*localSystem) Shutdown() {}
 
-func (*localSystem) Maxprocs() int {
+// Maxprocs returns the configured number of CPUs available to each
+// machine, or 1 if it is not configured.
+func (s *localSystem) Maxprocs() int {
+	if s.config.CPUs > 0 {
+		return s.config.CPUs
+	}
 	return 1
 }
 
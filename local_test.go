@@ -0,0 +1,24 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import "testing"
+
+func TestLocalMaxprocs(t *testing.T) {
+	for _, c := range []struct {
+		config LocalConfig
+		want   int
+	}{
+		{LocalConfig{}, 1},
+		{LocalConfig{CPUs: 4}, 4},
+	} {
+		if got, want := NewLocal(c.config).Maxprocs(), c.want; got != want {
+			t.Errorf("%+v: got %v, want %v", c.config, got, want)
+		}
+	}
+	if got, want := Local.Maxprocs(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -6,7 +6,11 @@ package bigmachine
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,6 +23,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/fatbin"
 	"github.com/grailbio/base/iofmt"
@@ -35,15 +40,37 @@ import (
 // store for each machine.
 const numKeepaliveReplyTimes = 10
 
-// TODO(marius): We could define a Gob decoder for machines that
-// encode its address and dial it on decode. On the other hand, it's
-// nice to be explicit about dialling.
-//
-// TODO(marius): When an driver execs a new machine, we should give
-// it an instance cookie that is included in the actual address.
-// Thus, we can check that are talking to the actual intended
-// instance and not just another machine that happens to run on the
-// same address.
+// MinKeepaliveSpike and keepaliveSpikeFactor determine when a
+// keepalive reply time is considered a latency spike: it must be at
+// least minKeepaliveSpike and exceed the average of recent reply
+// times by keepaliveSpikeFactor.
+const (
+	minKeepaliveSpike    = time.Second
+	keepaliveSpikeFactor = 5
+)
+
+// InstanceMismatch is the message of errors that indicate an
+// instance cookie mismatch.
+const instanceMismatch = "machine instance mismatch"
+
+// ErrInstanceMismatch is returned by calls to a machine whose
+// address names a different instance than the one that is serving
+// the address, for example because the address was reused by
+// another bigmachine process. Callers can test for it with
+// errors.Match.
+var ErrInstanceMismatch = errors.E(errors.Fatal, errors.Precondition, instanceMismatch)
+
+// DefaultStopTimeout is the amount of time for which a machine
+// waits for pending calls to complete when it is stopped without a
+// deadline.
+const defaultStopTimeout = 5 * time.Minute
+
+// StopReplyMargin is the amount of time reserved for the reply to
+// Supervisor.Stop when a machine is stopped with a deadline: the
+// machine's pending calls are given until the deadline, less the
+// margin, to complete, so that a successful stop replies before the
+// deadline.
+const stopReplyMargin = 5 * time.Second
 
 // RetryPolicy is the default retry policy used for machine calls.
 var retryPolicy = retry.Backoff(time.Second, 5*time.Second, 1.5)
@@ -118,7 +145,9 @@ type LoadInfo struct {
 // tolerance. Each machine comprises instances of each registered
 // bigmachine service. A Machine is created by the bigmachine driver
 // binary, but its address can be passed to other Machines which can
-// in turn connect to each other (through Dial).
+// in turn connect to each other (through Dial). Machines may also be
+// passed directly as RPC arguments and replies, in which case they
+// are dialed by the receiving process.
 //
 // Machines are created with (*B).Start.
 type Machine struct {
@@ -140,7 +169,49 @@ type Machine struct {
 	// process.
 	environ []string
 
+	// Files is the set of files to be staged onto a new machine.
+	files []File
+
+	// Image is the digest of the binary image exec'd on the
+	// machine, if it is known.
+	image digest.Digest
+	// CompressBinary is set if the binary image should be
+	// compressed when it is uploaded to the machine.
+	compressBinary bool
+
+	// HealthThresholds, if set, configures the machine's health
+	// checks.
+	healthThresholds *HealthThresholds
+	// UnhealthyAction determines what is done with the machine
+	// when it is unhealthy.
+	unhealthyAction UnhealthyAction
+
+	// Instance is the machine's instance cookie. It is assigned when
+	// the machine is started, and is embedded in the machine's
+	// address.
+	instance string
+
 	owner bool
+	// Reattach is set for owned machines that were started by a
+	// previous driver, and which are reattached from a session file.
+	// Such machines are not bootstrapped, nor are their services
+	// registered.
+	reattach bool
+
+	// B is the bigmachine session through which the machine was
+	// started or dialed. It is nil in some tests.
+	b *B
+	// System is the system on which the machine runs. It is nil
+	// in some tests.
+	system System
+	// Dialed is set for machines decoded from machine handles (see
+	// GobDecode): it is the machine tracked by the B for the handle's
+	// address, whose state and calls are those of the decoded
+	// machine. HandleCtx is the decoded machine's own context, which
+	// is canceled (by cancel) when the decoded machine is canceled or
+	// stopped; this does not affect the tracked machine.
+	dialed    *Machine
+	handleCtx context.Context
 
 	client *rpc.Client
 	cancel func()
@@ -150,6 +221,29 @@ type Machine struct {
 	err       error
 	waiters   []stateWaiter
 	cancelers map[canceler]struct{}
+	// unhealthy is the reason the machine was last reported
+	// unhealthy; it is empty if the machine is healthy.
+	unhealthy string
+	// failure classifies the machine's error, if it is known when
+	// the machine fails.
+	failure FailureKind
+	// canceled is set when the machine is canceled or stopped by
+	// the driver before it fails (see markCanceled).
+	canceled bool
+	// diskFull describes the disk exhausted by the machine, if any.
+	diskFull *diskFull
+	// oomKills is the number of OOM kills in the machine's cgroup,
+	// as last reported by its supervisor.
+	oomKills int64
+	// memoryPressure is the memory pressure last reported by the
+	// machine's supervisor.
+	memoryPressure string
+	// lastDiagnostics is the time of the machine's last diagnostics
+	// capture. DiagnosticsDone is closed when the last capture, which
+	// runs concurrently with the machine's loop, completes. They are
+	// accessed only by the machine's loop.
+	lastDiagnostics time.Time
+	diagnosticsDone chan struct{}
 
 	nextKeepalive       time.Time
 	numKeepalive        int
@@ -170,6 +264,9 @@ func (m *Machine) Owned() bool {
 // numKeepaliveReplyTimes keepalive reply latencies,
 // most recent first.
 func (m *Machine) KeepaliveReplyTimes() []time.Duration {
+	if m.dialed != nil {
+		return m.dialed.KeepaliveReplyTimes()
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	n := len(m.keepaliveReplyTimes)
@@ -186,6 +283,9 @@ func (m *Machine) KeepaliveReplyTimes() []time.Duration {
 // NextKeepalive returns the time at which the next keepalive
 // request is due.
 func (m *Machine) NextKeepalive() time.Time {
+	if m.dialed != nil {
+		return m.dialed.NextKeepalive()
+	}
 	m.mu.Lock()
 	t := m.nextKeepalive
 	m.mu.Unlock()
@@ -207,6 +307,12 @@ func (m *Machine) Hostname() string {
 
 // State returns the machine's current state.
 func (m *Machine) State() State {
+	if m.dialed != nil {
+		if m.handleCtx.Err() != nil {
+			return Stopped
+		}
+		return m.dialed.State()
+	}
 	return State(atomic.LoadInt64(&m.state))
 }
 
@@ -214,6 +320,20 @@ func (m *Machine) State() State {
 // provided state or greater.
 func (m *Machine) Wait(state State) <-chan struct{} {
 	c := make(chan struct{})
+	if m.dialed != nil {
+		if state <= m.State() {
+			close(c)
+			return c
+		}
+		go func() {
+			select {
+			case <-m.dialed.Wait(state):
+			case <-m.handleCtx.Done():
+			}
+			close(c)
+		}()
+		return c
+	}
 	m.mu.Lock()
 	if state <= m.State() {
 		close(c)
@@ -244,14 +364,138 @@ func (m *Machine) LoadInfo(ctx context.Context) (info LoadInfo, err error) {
 }
 
 // Cancel cancels all pending operations on machine m. The machine
-// is stopped with an error of context.Canceled.
+// is stopped with an error of context.Canceled. Canceling a decoded
+// machine (see GobDecode) affects only the decoded machine.
 func (m *Machine) Cancel() {
+	if m.dialed != nil {
+		m.cancel()
+		return
+	}
+	m.markCanceled()
+	m.cancel()
+}
+
+// Stop gracefully stops machine m. If m is owned and running, the
+// machine is first instructed to stop accepting new calls and to
+// wait for its pending calls to complete, until shortly before the
+// provided context's deadline, so that the machine can reply in time
+// (or, if the context has no deadline, for up to five minutes). The
+// machine's process then exits, releasing
+// its underlying resources. Finally, as with Cancel, pending
+// operations on m are canceled and the machine is stopped with an
+// error of context.Canceled. Stop returns once the machine is
+// stopped. As with Cancel, stopping a decoded machine (see GobDecode)
+// affects only the decoded machine.
+func (m *Machine) Stop(ctx context.Context) error {
+	if m.dialed != nil {
+		m.cancel()
+		return nil
+	}
+	m.markCanceled()
+	var err error
+	if m.owner && m.State() == Running {
+		timeout := defaultStopTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = drainTimeout(time.Until(deadline))
+		}
+		err = m.call(ctx, "Supervisor.Stop", timeout, nil)
+	}
 	m.cancel()
+	select {
+	case <-m.Wait(Stopped):
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// drainTimeout returns the amount of time given to a stopped
+// machine's pending calls when the stop must complete within the
+// provided amount of time. The reply margin is reduced for short
+// stops, so that they may still drain.
+func drainTimeout(remaining time.Duration) time.Duration {
+	margin := stopReplyMargin
+	if remaining < 2*margin {
+		margin = remaining / 2
+	}
+	if remaining -= margin; remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// A machineHandle is the gob representation of a machine.
+type machineHandle struct {
+	Addr     string
+	Maxprocs int
+	// System is the name of the system on which the machine runs.
+	System string
+}
+
+// GobEncode implements gob.GobEncoder. Machines are encoded as
+// handles containing their address, so that machines may be passed
+// to other machines as RPC arguments and replies.
+func (m *Machine) GobEncode() ([]byte, error) {
+	var b bytes.Buffer
+	h := machineHandle{Addr: m.Addr, Maxprocs: m.Maxprocs}
+	system := m.system
+	if m.dialed != nil {
+		system = m.dialed.system
+	}
+	if system != nil {
+		h.System = system.Name()
+	}
+	err := gob.NewEncoder(&b).Encode(h)
+	return b.Bytes(), err
+}
+
+// GobDecode implements gob.GobDecoder. A decoded machine is a
+// non-owned handle to the machine tracked at its address by a B
+// running in this process: one that already tracks the address, or
+// else the most recently started one, which then starts tracking a
+// non-owned machine at the address. Decoding the same address
+// repeatedly does not start additional machines. Decoding does not
+// communicate with the machine: its instance is checked by the
+// tracked machine's calls, which fail the machine with
+// ErrInstanceMismatch if it is served by a different instance.
+//
+// The decoded machine's state, and its calls, are those of the
+// tracked machine, except that canceling or stopping the decoded
+// machine stops only the decoded machine.
+func (m *Machine) GobDecode(p []byte) error {
+	var h machineHandle
+	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&h); err != nil {
+		return err
+	}
+	b := lookupB(h.Addr)
+	if b == nil {
+		return errors.E(errors.Precondition, fmt.Sprintf("cannot decode machine %s: no bigmachine session", h.Addr))
+	}
+	// Machines of systems not initialized by this process are
+	// dialed through the primary system.
+	system := b.system
+	if b.clients[h.System] != nil {
+		system = b.systems[h.System]
+	}
+	m.Addr = h.Addr
+	m.Maxprocs = h.Maxprocs
+	m.owner = false
+	m.dialed = b.track(h.Addr, system)
+	m.handleCtx, m.cancel = context.WithCancel(context.Background())
+	return nil
 }
 
 // Err returns a machine's error. Err is only well-defined when the machine
 // is in Stopped state.
 func (m *Machine) Err() error {
+	if m.dialed != nil {
+		if err := m.handleCtx.Err(); err != nil {
+			return err
+		}
+		return m.dialed.Err()
+	}
 	m.mu.Lock()
 	err := m.err
 	m.mu.Unlock()
@@ -259,28 +503,37 @@ func (m *Machine) Err() error {
 }
 
 func (m *Machine) start(b *B) {
+	m.b = b
+	if m.system == nil && b != nil {
+		m.system = b.System()
+	}
 	if m.client == nil {
-		m.client = b.client
+		m.client = b.systemClient(m.system)
 	}
 	if m.keepalivePeriod == 0 {
-		m.keepalivePeriod, m.keepaliveTimeout, m.keepaliveRpcTimeout = b.System().KeepaliveConfig()
+		m.keepalivePeriod, m.keepaliveTimeout, m.keepaliveRpcTimeout = m.system.KeepaliveConfig()
 	}
 	m.cancelers = make(map[canceler]struct{})
 	ctx := context.Background()
 	ctx, m.cancel = context.WithCancel(ctx)
 	go func() {
 		// TODO(marius): fix tests that rely on this.
-		var system System
-		if b != nil {
-			system = b.System()
-		}
-		m.loop(ctx, system)
+		m.loop(ctx, m.system)
 		m.cancel()
+		m.finishDiagnostics()
 	}()
 }
 
 func (m *Machine) setError(err error) {
 	m.mu.Lock()
+	if m.err != nil {
+		// Keep the original error, which describes the cause of
+		// the machine's failure; subsequent errors are usually its
+		// consequences.
+		m.mu.Unlock()
+		log.Debug.Printf("%s: %v", m.Addr, err)
+		return
+	}
 	m.err = err
 	m.mu.Unlock()
 	m.setState(Stopped)
@@ -293,6 +546,7 @@ func (m *Machine) errorf(format string, args ...interface{}) {
 
 func (m *Machine) setState(s State) {
 	m.mu.Lock()
+	old := m.State()
 	var triggered []chan struct{}
 	ws := m.waiters
 	m.waiters = nil
@@ -310,10 +564,32 @@ func (m *Machine) setState(s State) {
 		}
 		m.cancelers = make(map[canceler]struct{})
 	}
+	err := m.err
 	m.mu.Unlock()
 	for _, c := range triggered {
 		close(c)
 	}
+	if s <= old {
+		return
+	}
+	switch s {
+	case Starting:
+		m.event(Event{Kind: EventStarting})
+	case Running:
+		m.event(Event{Kind: EventRunning})
+	case Stopped:
+		m.event(Event{Kind: EventStopped, Err: err})
+	}
+}
+
+// event publishes the provided event, pertaining to machine m,
+// to the machine's B.
+func (m *Machine) event(e Event) {
+	if m.b == nil {
+		return
+	}
+	e.Machine = m
+	m.b.publish(e)
 }
 
 func (m *Machine) loop(ctx context.Context, system System) {
@@ -331,7 +607,7 @@ func (m *Machine) loop(ctx context.Context, system System) {
 				}
 			}()
 		}
-		if !m.NoExec {
+		if !m.NoExec && !m.reattach {
 			// If we're the owner, loop is called after the machine was started
 			// by the underlying system. We first wait for the machine to come
 			// up (we give it 2 minutes).
@@ -366,6 +642,25 @@ func (m *Machine) loop(ctx context.Context, system System) {
 		return
 	}
 
+	if m.b != nil && !m.image.IsZero() {
+		// The machine is now running our image, and can serve it to
+		// its peers.
+		m.b.binaries.add(m.image, m.Addr)
+		go func() {
+			<-m.Wait(Stopped)
+			m.b.binaries.remove(m.image, m.Addr)
+		}()
+	}
+
+	if m.owner && m.instance != "" {
+		// Claim the instance: machines that were not execed with
+		// an instance cookie (e.g., in tests) adopt it here.
+		if err := m.retryCall(ctx, 5*time.Minute, 25*time.Second, "Supervisor.SetInstance", m.instance, nil); err != nil {
+			m.setError(err)
+			return
+		}
+	}
+
 	if !m.owner {
 		// If we're not the owner, we maintain machine state
 		// (up or down) by maintaining a periodic ping.
@@ -384,15 +679,33 @@ func (m *Machine) loop(ctx context.Context, system System) {
 
 	// If we're the owner, there's a bunch of additional setup to perform:
 	//
-	//	(1) instantiate the machine's services
-	//	(2) duplicate the machine's standard output and error to our own
-	//	(3) maintain a keepalive
-	//	(4) take emergency pre-OOM heap profiles if the keepalive reply
+	//	(1) stage the machine's files
+	//	(2) instantiate the machine's services
+	//	(3) duplicate the machine's standard output and error to our own
+	//	(4) maintain a keepalive
+	//	(5) take emergency pre-OOM heap profiles if the keepalive reply
 	//	  indicates that we're close to machine death
-	for name, iface := range m.services {
-		if err := m.retryCall(ctx, 5*time.Minute, 25*time.Second, "Supervisor.Register", service{name, iface}, nil); err != nil {
-			m.setError(errors.E(err, fmt.Sprintf("Supervisor.Register %s", name)))
-			return
+	//
+	// The files and services of reattached machines were set up by a
+	// previous driver.
+	if !m.reattach {
+		for _, f := range m.files {
+			if err := m.stageFile(ctx, f); err != nil {
+				m.setError(errors.E(err, fmt.Sprintf("stage file %s", f.Name)))
+				return
+			}
+		}
+		for name, iface := range m.services {
+			if err := m.retryCall(ctx, 5*time.Minute, 25*time.Second, "Supervisor.Register", service{name, iface}, nil); err != nil {
+				m.setError(errors.E(err, fmt.Sprintf("Supervisor.Register %s", name)))
+				return
+			}
+		}
+		if m.healthThresholds != nil {
+			if err := m.retryCall(ctx, 5*time.Minute, 25*time.Second, "Supervisor.SetHealthThresholds", *m.healthThresholds, nil); err != nil {
+				m.setError(errors.E(err, "Supervisor.SetHealthThresholds"))
+				return
+			}
 		}
 	}
 
@@ -419,35 +732,79 @@ func (m *Machine) loop(ctx context.Context, system System) {
 				time.Since(start), m.keepaliveTimeout, m.keepaliveRpcTimeout, err)
 			return
 		}
+		latency := time.Since(start)
 		m.mu.Lock()
-		m.keepaliveReplyTimes[m.numKeepalive%len(m.keepaliveReplyTimes)] = time.Since(start)
+		slow := isKeepaliveSlow(latency, m.keepaliveReplyTimes[:], m.numKeepalive)
+		m.keepaliveReplyTimes[m.numKeepalive%len(m.keepaliveReplyTimes)] = latency
 		m.numKeepalive++
 		m.nextKeepalive = time.Now().Add(reply.Next)
+		wasUnhealthy := m.unhealthy
+		wasHealthy := wasUnhealthy == ""
+		m.unhealthy = ""
+		if !reply.Healthy {
+			// Older supervisors do not provide a reason.
+			m.unhealthy = reply.Reason
+			if m.unhealthy == "" {
+				m.unhealthy = "unhealthy"
+			}
+		}
 		m.mu.Unlock()
 		next := reply.Next
 		if next > m.keepalivePeriod {
 			next = m.keepalivePeriod
 		}
 		nextc := time.After(next / 2)
+		if slow {
+			m.event(Event{Kind: EventKeepaliveSlow, Latency: latency})
+		}
 
-		// Check memory stats and take a heap profile if we're likely to die soon.
-		//
-		// TODO(marius): rate limit, collect, or rotate these?
-		if !reply.Healthy {
-			log.Printf("%s: supervisor indicated machine was unhealthy, taking heap profile and expvar dump", m.Addr)
-			suffix := "." + m.Hostname() + "-" + time.Now().Format("20060102T150405")
-			path := "heap" + suffix
-			if err := m.saveProfile(ctx, "heap", path); err != nil {
-				log.Error.Printf("%s: heap profile failed: %v", m.Addr, err)
-			} else {
-				log.Printf("%s: heap profile saved to %s", m.Addr, path)
+		if full := reply.DiskFull; full != nil {
+			m.mu.Lock()
+			m.diskFull = full
+			m.mu.Unlock()
+			m.event(Event{Kind: EventDiskFull, Err: ErrDiskFull, Reason: full.String()})
+			log.Printf("%s: supervisor indicated disk was exhausted (%s); stopping machine", m.Addr, full)
+			m.stopFailed(FailureDiskFull, ErrDiskFull)
+			return
+		}
+		m.mu.Lock()
+		kills := reply.OOMKills - m.oomKills
+		m.oomKills = reply.OOMKills
+		pressured := reply.MemoryPressure != "" && m.memoryPressure == ""
+		m.memoryPressure = reply.MemoryPressure
+		m.mu.Unlock()
+		if kills > 0 {
+			err := errors.E(errors.OOM, fmt.Sprintf("%d processes in the machine's cgroup killed by the kernel", kills))
+			log.Error.Printf("%s: %v", m.Addr, err)
+			m.event(Event{Kind: EventOOM, Err: err})
+		}
+		if pressured {
+			log.Printf("%s: supervisor indicated memory pressure (%s)", m.Addr, reply.MemoryPressure)
+			m.event(Event{Kind: EventMemoryPressure, Reason: reply.MemoryPressure})
+		}
+		// Only publish transitions (or changes in reason) so that
+		// subscribers are not flooded while a machine stays unhealthy.
+		if reason := m.Unhealthy(); !reply.Healthy && reason != wasUnhealthy {
+			m.event(Event{Kind: EventUnhealthy, Reason: reason})
+		}
+		switch {
+		case reply.Healthy:
+			if !wasHealthy && m.unhealthyAction == UnhealthyCordon {
+				log.Printf("%s: machine is healthy again; uncordoning", m.Addr)
 			}
-			path = "vars" + suffix
-			if err = m.saveExpvars(ctx, path); err != nil {
-				log.Error.Printf("%s: failed to retrieve expvars: %v", m.Addr, err)
-			} else {
-				log.Printf("%s: expvars saved to %s", m.Addr, path)
+		case m.unhealthyAction == UnhealthyStop:
+			reason := m.Unhealthy()
+			log.Printf("%s: supervisor indicated machine was unhealthy (%s); stopping machine", m.Addr, reason)
+			m.stopFailed(FailureUnhealthy, errors.E(errors.Unavailable, fmt.Sprintf("machine unhealthy: %s", reason)))
+			return
+		case m.unhealthyAction == UnhealthyCordon:
+			if wasHealthy {
+				log.Printf("%s: supervisor indicated machine was unhealthy (%s); cordoning machine", m.Addr, m.Unhealthy())
 			}
+		default:
+			// Capture diagnostics, since we're likely to die soon.
+			log.Printf("%s: supervisor indicated machine was unhealthy (%s), capturing diagnostics", m.Addr, m.Unhealthy())
+			m.captureDiagnostics(ctx, m.Unhealthy())
 		}
 
 		select {
@@ -480,7 +837,9 @@ func (m *Machine) tryMonitorOOMs(ctx context.Context, system System) {
 			log.Debug.Printf("%s kmsg: %s", m.Addr, scan.Text())
 		}
 		if strings.Contains(scan.Text(), look) {
-			m.setError(errors.E(errors.OOM, "bigmachine process killed by the kernel"))
+			err := errors.E(errors.OOM, "bigmachine process killed by the kernel")
+			m.event(Event{Kind: EventOOM, Err: err})
+			m.fail(FailureOOM, err)
 		}
 	}
 	if err := scan.Err(); err != nil && err != context.Canceled {
@@ -488,6 +847,28 @@ func (m *Machine) tryMonitorOOMs(ctx context.Context, system System) {
 	}
 }
 
+// isKeepaliveSlow tells whether the keepalive reply time latency
+// is a spike relative to the previously recorded reply times (of
+// which there are n in total): that is, if it is at least
+// minKeepaliveSpike, and exceeds the average recorded reply time by
+// a factor of keepaliveSpikeFactor.
+func isKeepaliveSlow(latency time.Duration, times []time.Duration, n int) bool {
+	if latency < minKeepaliveSpike {
+		return false
+	}
+	if n > len(times) {
+		n = len(times)
+	}
+	if n == 0 {
+		return true
+	}
+	var total time.Duration
+	for _, t := range times[:n] {
+		total += t
+	}
+	return latency > keepaliveSpikeFactor*total/time.Duration(n)
+}
+
 func (m *Machine) ping(ctx context.Context) error {
 	return m.retryCall(ctx, 9*time.Minute, 3*time.Minute, "Supervisor.Ping", 0, nil)
 }
@@ -514,30 +895,104 @@ func (m *Machine) context(ctx context.Context) (mctx context.Context, cancel fun
 	}
 }
 
+// execEnviron returns the environment with which the machine's image
+// is exec'd. The instance cookie is passed through the environment so
+// that the new image serves only calls addressed to this instance.
+func (m *Machine) execEnviron() []string {
+	environ := m.environ
+	if m.instance != "" {
+		environ = append(environ[:len(environ):len(environ)], "BIGMACHINE_INSTANCE="+m.instance)
+	}
+	return environ
+}
+
 func (m *Machine) exec(ctx context.Context) error {
 	self, err := fatbin.Self()
 	if err != nil {
 		return err
 	}
+	parent := ctx
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 	defer cancel()
 	var info Info
 	if err := m.call(ctx, "Supervisor.Info", struct{}{}, &info); err != nil {
 		return err
 	}
+	image, err := imageDigest(self, info.Goos, info.Goarch)
+	if err != nil {
+		return err
+	}
+	// If the machine is already running our image, there's no need to
+	// exec it again, unless we need to amend its environment. (The
+	// instance cookie is claimed separately.)
+	if info.Digest == image && len(m.environ) == 0 {
+		m.image = image
+		log.Debug.Printf("%s: already running binary %v; skipping exec", m.Addr, image)
+		return m.call(ctx, "Supervisor.Setargs", os.Args, nil)
+	}
 	// First set the correct environment and arguments.
-	if err := m.call(ctx, "Supervisor.Setenv", m.environ, nil); err != nil {
+	if err := m.call(ctx, "Supervisor.Setenv", m.execEnviron(), nil); err != nil {
 		return err
 	}
 	if err := m.call(ctx, "Supervisor.Setargs", os.Args, nil); err != nil {
 		return err
 	}
-	rc, err := self.Open(info.Goos, info.Goarch)
-	if err != nil {
+	m.image = image
+	// Try the machine's binary cache first, and send the image only
+	// if it is not cached there.
+	// Supervisors that do not support the cache (e.g., bootstrap
+	// binaries) fail the call outright.
+	err = m.call(ctx, "Supervisor.ExecCached", image, nil)
+	if err == nil || errors.Is(errors.Net, err) {
+		return err
+	}
+	cancel()
+	return m.sendImage(parent, self, info, image)
+}
+
+// sendImage transfers the binary image with the provided digest to
+// the machine and execs it. If the machine is managed by a B, the
+// image is retrieved from a peer machine that already runs it, if
+// possible; otherwise it is sent by the driver. Transfers are
+// coordinated by the B's binarySources.
+func (m *Machine) sendImage(ctx context.Context, self *fatbin.Reader, info Info, image digest.Digest) error {
+	usePeers := m.b != nil
+	for {
+		var (
+			peer    string
+			release = func() {}
+			err     error
+		)
+		if m.b != nil {
+			peer, release, err = m.b.binaries.acquire(ctx, image, usePeers)
+			if err != nil {
+				return err
+			}
+		}
+		if peer != "" {
+			callCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+			err = m.call(callCtx, "Supervisor.ExecFrom", execFrom{peer, image}, nil)
+			cancel()
+			release()
+			switch {
+			case err == nil || errors.Is(errors.Net, err):
+				return err
+			case errors.Is(errors.Remote, err):
+				// The machine could not retrieve the image from the
+				// peer; don't use it again.
+				log.Error.Printf("%s: failed to retrieve binary from %s: %v", m.Addr, peer, err)
+				m.b.binaries.remove(image, peer)
+			default:
+				// The machine does not support peer transfers
+				// (e.g., it runs a bootstrap binary).
+				usePeers = false
+			}
+			continue
+		}
+		err = m.upload(ctx, self, info, image)
+		release()
 		return err
 	}
-	defer rc.Close()
-	return m.call(ctx, "Supervisor.Exec", rc, nil)
 }
 
 func (m *Machine) call(ctx context.Context, serviceMethod string, arg, reply interface{}) (err error) {
@@ -558,6 +1013,9 @@ func (m *Machine) call(ctx context.Context, serviceMethod string, arg, reply int
 		}()
 	}
 	err = m.client.Call(ctx, m.Addr, serviceMethod, arg, reply)
+	if err != nil && isInstanceMismatch(err) {
+		err = ErrInstanceMismatch
+	}
 	return err
 }
 
@@ -575,6 +1033,11 @@ func (m *Machine) retryCall(ctx context.Context, overallTimeout, rpcTimeout time
 			}
 			return nil
 		}
+		if err == ErrInstanceMismatch {
+			// There's no point in retrying: we're talking to the
+			// wrong machine.
+			return err
+		}
 		log.Debug.Printf("%s %s: %v; retrying (%d)", m.Addr, serviceMethod, err, retries)
 		// TODO(marius): this isn't quite right. Introduce an errors package
 		// similar to Reflow's here to categorize errors properly.
@@ -596,6 +1059,22 @@ func (m *Machine) retryCall(ctx context.Context, overallTimeout, rpcTimeout time
 //
 // If a machine fails its keepalive, pending calls are canceled.
 func (m *Machine) Call(ctx context.Context, serviceMethod string, arg, reply interface{}) error {
+	if m.dialed != nil {
+		if err := m.handleCtx.Err(); err != nil {
+			return errors.E(errors.Fatal, errors.Unavailable, err)
+		}
+		// Calls are canceled when the decoded machine is.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-m.handleCtx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		return m.dialed.Call(ctx, serviceMethod, arg, reply)
+	}
 	for {
 		switch state := m.State(); state {
 		case Running:
@@ -607,7 +1086,9 @@ func (m *Machine) Call(ctx context.Context, serviceMethod string, arg, reply int
 			}
 			fallthrough
 		case Stopped:
-			if err := m.Err(); err != nil {
+			if err := m.Err(); err == ErrInstanceMismatch {
+				return err
+			} else if err != nil {
 				return errors.E(errors.Fatal, errors.Unavailable, err)
 			}
 			return errors.E(errors.Fatal, errors.Unavailable, fmt.Sprintf("machine %s stopped", m.Addr))
@@ -633,13 +1114,38 @@ func (m *Machine) RetryCall(ctx context.Context, serviceMethod string, arg, repl
 	}
 }
 
+// CallStream invokes a method named by a service on this machine that
+// streams its replies over a channel (see package rpc), returning an
+// iterator over the streamed values. The iterator must be exhausted
+// or closed by the caller. CallStream waits for the machine in the
+// same manner as Call.
+func (m *Machine) CallStream(ctx context.Context, serviceMethod string, arg interface{}) (*rpc.StreamIterator, error) {
+	var it *rpc.StreamIterator
+	if err := m.Call(ctx, serviceMethod, arg, &it); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// OpenStream opens a bidirectional stream to a method named by a
+// service on this machine that takes an *rpc.Stream (see package
+// rpc). The caller must close the returned stream. OpenStream waits
+// for the machine in the same manner as Call.
+func (m *Machine) OpenStream(ctx context.Context, serviceMethod string, arg interface{}) (*rpc.Stream, error) {
+	var stream *rpc.Stream
+	if err := m.Call(ctx, serviceMethod, arg, &stream); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
 // SaveProfile saves a profile to a local file. The name of the file is
 // returned.
-func (m *Machine) saveProfile(ctx context.Context, which, path string) error {
+func (m *Machine) saveProfile(ctx context.Context, req profileRequest, path string) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
 	var rc io.ReadCloser
-	err := m.Call(ctx, "Supervisor.Profile", profileRequest{which, 0, false}, &rc)
+	err := m.Call(ctx, "Supervisor.Profile", req, &rc)
 	if err != nil {
 		return err
 	}
@@ -668,6 +1174,45 @@ func (m *Machine) saveExpvars(ctx context.Context, path string) error {
 	return json.NewEncoder(f).Encode(vars)
 }
 
+// newInstance returns a new, random, instance cookie.
+func newInstance() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// withInstance returns the address addr with the provided instance
+// cookie embedded in it. The cookie is encoded as the first element
+// of the address's path, so that calls to the address are of the
+// form
+//
+//	https://host:port/instance/bigrpc/Service.Method
+func withInstance(addr, instance string) string {
+	return strings.TrimRight(addr, "/") + "/" + instance + "/"
+}
+
+// instanceOf returns the instance cookie embedded in addr, or
+// the empty string if addr does not contain one.
+func instanceOf(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(u.Path, "/")
+}
+
+// isInstanceMismatch tells whether err is a remote error
+// indicating an instance cookie mismatch.
+func isInstanceMismatch(err error) bool {
+	if !errors.Is(errors.Remote, err) {
+		return false
+	}
+	cause := errors.Recover(err).Err
+	return cause != nil && errors.Match(errors.E(errors.Precondition, instanceMismatch), cause)
+}
+
 func truncatef(v interface{}) string {
 	b := limitbuf.NewLogger(512)
 	fmt.Fprint(b, v)
@@ -6,6 +6,7 @@ package bigmachine
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"io"
@@ -13,10 +14,14 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"runtime"
 	"testing"
 	"time"
 
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/fatbin"
 	"github.com/grailbio/bigmachine/rpc"
 )
 
@@ -28,6 +33,21 @@ type fakeSupervisor struct {
 	Image         []byte
 	LastKeepalive time.Time
 	Hung          bool
+	// Digest, if set, is the digest of the supervisor's binary.
+	Digest digest.Digest
+	// Cached is the set of binaries in the supervisor's cache.
+	Cached map[digest.Digest][]byte
+	// Upload is the binary uploaded so far by UploadChunk.
+	Upload []byte
+	// FailChunks is the number of chunk uploads that should fail.
+	FailChunks int
+	// Compressed is set if a compressed chunk was uploaded.
+	Compressed bool
+	// DiskFull, if set, is reported in keepalive replies.
+	DiskFull *diskFull
+	// Unchunked, if set, indicates that the supervisor does not
+	// advertise support for chunked uploads.
+	Unchunked bool
 }
 
 func (s *fakeSupervisor) Setenv(ctx context.Context, env []string, _ *struct{}) error {
@@ -46,6 +66,55 @@ func (s *fakeSupervisor) Exec(ctx context.Context, exec io.Reader, _ *struct{})
 	return err
 }
 
+func (s *fakeSupervisor) ExecCached(ctx context.Context, d digest.Digest, _ *struct{}) error {
+	image, ok := s.Cached[d]
+	if !ok {
+		return errors.New("not cached")
+	}
+	s.Image = image
+	return nil
+}
+
+func (s *fakeSupervisor) UploadOffset(ctx context.Context, d digest.Digest, offset *int64) error {
+	*offset = int64(len(s.Upload))
+	return nil
+}
+
+func (s *fakeSupervisor) UploadChunk(ctx context.Context, chunk uploadChunk, offset *int64) error {
+	if s.FailChunks > 0 {
+		s.FailChunks--
+		return errors.New("chunk failed")
+	}
+	if chunk.Offset != int64(len(s.Upload)) {
+		return errors.New("bad offset")
+	}
+	data := chunk.Data
+	if chunk.Compressed {
+		s.Compressed = true
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	if digester.FromBytes(data) != chunk.Digest {
+		return errors.New("bad digest")
+	}
+	s.Upload = append(s.Upload, data...)
+	*offset = int64(len(s.Upload))
+	return nil
+}
+
+func (s *fakeSupervisor) ExecUpload(ctx context.Context, d digest.Digest, _ *struct{}) error {
+	if digester.FromBytes(s.Upload) != d {
+		return errors.New("bad digest")
+	}
+	s.Image = s.Upload
+	return nil
+}
+
 func (s *fakeSupervisor) Tail(ctx context.Context, fd int, rc *io.ReadCloser) error {
 	return errors.New("not supported")
 }
@@ -59,6 +128,10 @@ func (s *fakeSupervisor) Info(ctx context.Context, _ struct{}, info *Info) error
 	info.Goos = runtime.GOOS
 	info.Goarch = runtime.GOARCH
 	info.Digest = fakeDigest
+	info.ChunkedUpload = !s.Unchunked
+	if !s.Digest.IsZero() {
+		info.Digest = s.Digest
+	}
 	return nil
 }
 
@@ -70,9 +143,21 @@ func (s *fakeSupervisor) Keepalive(ctx context.Context, next time.Duration, repl
 	s.LastKeepalive = time.Now()
 	reply.Next = next
 	reply.Healthy = true
+	reply.DiskFull = s.DiskFull
 	return nil
 }
 
+// Stop waits for the drain timeout, as if pending calls never
+// completed.
+func (s *fakeSupervisor) Stop(ctx context.Context, timeout time.Duration, _ *struct{}) error {
+	select {
+	case <-time.After(timeout):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s *fakeSupervisor) Hang(ctx context.Context, _ struct{}, _ *struct{}) error {
 	<-ctx.Done()
 	return ctx.Err()
@@ -81,6 +166,12 @@ func (s *fakeSupervisor) Hang(ctx context.Context, _ struct{}, _ *struct{}) erro
 func newTestMachine(t *testing.T, params ...Param) (m *Machine, supervisor *fakeSupervisor, shutdown func()) {
 	t.Helper()
 	supervisor = new(fakeSupervisor)
+	m, shutdown = newTestMachineWithSupervisor(t, supervisor, params...)
+	return m, supervisor, shutdown
+}
+
+func newTestMachineWithSupervisor(t *testing.T, supervisor *fakeSupervisor, params ...Param) (m *Machine, shutdown func()) {
+	t.Helper()
 	srv := rpc.NewServer()
 	srv.Register("Supervisor", supervisor)
 	httpsrv := httptest.NewServer(srv)
@@ -101,7 +192,7 @@ func newTestMachine(t *testing.T, params ...Param) (m *Machine, supervisor *fake
 		param.applyParam(m)
 	}
 	m.start(nil)
-	return m, supervisor, func() {
+	return m, func() {
 		m.Cancel()
 		select {
 		case <-m.Wait(Stopped):
@@ -136,6 +227,144 @@ func TestMachineBootup(t *testing.T) {
 	}
 }
 
+func TestMachineDiskFull(t *testing.T) {
+	full := &diskFull{Path: "/tmp", Total: 100 * data.GiB, Free: data.MiB}
+	m, shutdown := newTestMachineWithSupervisor(t, &fakeSupervisor{DiskFull: full})
+	defer shutdown()
+
+	// The machine fails without waiting for its process to drain.
+	select {
+	case <-m.Wait(Stopped):
+	case <-time.After(time.Minute):
+		t.Fatal("machine did not fail")
+	}
+	if err := m.Err(); err != ErrDiskFull {
+		t.Errorf("bad error %v", err)
+	}
+	if got, want := m.Failure(), FailureDiskFull; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Pools that request disk growth start replacements with larger disks.
+	params := []Param{Services{}, Resources{CPUs: 2, Disk: 10 * data.GiB}}
+	if _, ok := growDisk(params, full.Total); ok {
+		t.Error("disk grown without DiskGrowth")
+	}
+	params, ok := growDisk(append(params, DiskGrowth(2)), full.Total)
+	if !ok {
+		t.Fatal("disk not grown")
+	}
+	var r Resources
+	for _, p := range params {
+		if p, ok := p.(Resources); ok {
+			r = r.Max(p)
+		}
+	}
+	if got, want := r, (Resources{CPUs: 2, Disk: 200 * data.GiB}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMachineCanceledFailure(t *testing.T) {
+	m, _, shutdown := newTestMachine(t)
+	defer shutdown()
+	<-m.Wait(Running)
+	// The machine is classified as canceled even if it stops with
+	// another error (e.g., a failed keepalive) before it notices
+	// the cancellation.
+	m.markCanceled()
+	m.setError(errors.New("keepalive failed"))
+	m.Cancel()
+	<-m.Wait(Stopped)
+	if got, want := m.Failure(), FailureCanceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	for _, c := range []struct {
+		remaining, want time.Duration
+	}{
+		{time.Minute, time.Minute - stopReplyMargin},
+		{2 * stopReplyMargin, stopReplyMargin},
+		{4 * time.Second, 2 * time.Second},
+		{-time.Second, 0},
+	} {
+		if got, want := drainTimeout(c.remaining), c.want; got != want {
+			t.Errorf("%s: got %v, want %v", c.remaining, got, want)
+		}
+	}
+}
+
+func TestMachineSameBinary(t *testing.T) {
+	self, err := fatbin.Self()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := imageDigest(self, runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	supervisor := &fakeSupervisor{Digest: d}
+	m, shutdown := newTestMachineWithSupervisor(t, supervisor)
+	defer shutdown()
+	<-m.Wait(Running)
+	if supervisor.Image != nil {
+		t.Error("binary was exec'd")
+	}
+
+	// Binaries are exec'd from the cache if they are present.
+	supervisor = &fakeSupervisor{Cached: map[digest.Digest][]byte{d: []byte("cached")}}
+	m, shutdown = newTestMachineWithSupervisor(t, supervisor)
+	defer shutdown()
+	<-m.Wait(Running)
+	if got, want := string(supervisor.Image), "cached"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMachineUploadResume(t *testing.T) {
+	supervisor := &fakeSupervisor{FailChunks: 1}
+	m, shutdown := newTestMachineWithSupervisor(t, supervisor, CompressBinary(true))
+	defer shutdown()
+	<-m.Wait(Running)
+	r, err := binary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(supervisor.Image, image) {
+		t.Error("image does not match")
+	}
+	if !supervisor.Compressed {
+		t.Error("image was not compressed")
+	}
+}
+
+func TestMachineUploadUnsupported(t *testing.T) {
+	supervisor := &fakeSupervisor{Unchunked: true}
+	m, shutdown := newTestMachineWithSupervisor(t, supervisor)
+	defer shutdown()
+	<-m.Wait(Running)
+	if supervisor.Upload != nil {
+		t.Error("binary was uploaded in chunks")
+	}
+	r, err := binary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(supervisor.Image, image) {
+		t.Error("image does not match")
+	}
+}
+
 func TestMachineEnv(t *testing.T) {
 	m, supervisor, shutdown := newTestMachine(t, Environ{"test=yes"})
 	defer shutdown()
@@ -0,0 +1,289 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
+)
+
+// poolRetryPolicy is the retry policy used by pools when
+// machine starts fail.
+var poolRetryPolicy = retry.Backoff(5*time.Second, time.Minute, 1.5)
+
+// A Pool is a set of machines, started by a B, whose size is
+// maintained at a target. Whenever a member machine stops (e.g.,
+// because it failed its keepalive, or because an OOM was detected),
+// it is removed from the pool and a replacement machine is started
+// with the same parameters as the original.
+//
+// Pools are created by (*B).Pool.
+type Pool struct {
+	b *B
+
+	ctx    context.Context
+	cancel func()
+
+	// reconcilec is used to signal the pool's maintenance loop that
+	// its membership or target has changed.
+	reconcilec chan struct{}
+
+	mu sync.Mutex
+	// params are the parameters with which the pool's machines are
+	// started. They may be amended as machines fail; see DiskGrowth.
+	params []Param
+	// target is the desired size of the pool.
+	target int
+	// pending is the number of machines currently being started
+	// by the underlying system.
+	pending int
+	// members is the set of machines that are in the pool and that
+	// have not yet stopped.
+	members map[*Machine]bool
+	// changed is closed (and replaced) whenever the pool's
+	// membership changes.
+	changed chan struct{}
+}
+
+// Pool creates a new pool of n machines that are configured
+// according to the provided parameters. The machines are started
+// asynchronously; callers can use (*Pool).Changed to be notified as
+// machines become available. The pool is maintained until its
+// context is canceled or it is closed, at which time its machines
+// are also canceled.
+func (b *B) Pool(ctx context.Context, n int, params ...Param) *Pool {
+	p := &Pool{
+		b:          b,
+		params:     params,
+		reconcilec: make(chan struct{}, 1),
+		target:     n,
+		members:    make(map[*Machine]bool),
+		changed:    make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	go p.maintain()
+	return p
+}
+
+// Machines returns a snapshot of the pool's healthy members: that is,
+// the pool's machines that are in Running state and are not cordoned.
+func (p *Pool) Machines() []*Machine {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	machines := make([]*Machine, 0, len(p.members))
+	for m := range p.members {
+		if m.State() == Running && !m.Cordoned() {
+			machines = append(machines, m)
+		}
+	}
+	return machines
+}
+
+// Changed returns a channel that is closed the next time the
+// pool's membership changes: when a machine is added to the pool,
+// becomes available, or is removed from the pool.
+func (p *Pool) Changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changed
+}
+
+// Size returns the pool's current target size.
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.target
+}
+
+// Resize sets the pool's target size to n. If the pool is grown,
+// new machines are started; if it is shrunk, excess machines are
+// stopped, preferring machines that are not yet running.
+func (p *Pool) Resize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	p.mu.Lock()
+	p.target = n
+	p.mu.Unlock()
+	p.reconcile()
+}
+
+// Remove removes machine m from the pool and stops it. The pool's
+// target size is decremented so that the machine is not replaced.
+// Remove returns false if m is not a member of the pool.
+func (p *Pool) Remove(m *Machine) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.members[m] {
+		return false
+	}
+	delete(p.members, m)
+	p.target--
+	p.notify()
+	p.stop(m)
+	return true
+}
+
+// Close tears down the pool: its maintenance is stopped, and all
+// of its machines are canceled.
+func (p *Pool) Close() {
+	p.cancel()
+}
+
+// reconcile signals the maintenance loop that it should reconcile
+// the pool's membership with its target.
+func (p *Pool) reconcile() {
+	select {
+	case p.reconcilec <- struct{}{}:
+	default:
+	}
+}
+
+// notify wakes up waiters on the pool's membership. It must be
+// called with p.mu held.
+func (p *Pool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *Pool) maintain() {
+	var retries int
+	p.reconcile()
+	for {
+		select {
+		case <-p.reconcilec:
+		case <-p.ctx.Done():
+			p.mu.Lock()
+			for m := range p.members {
+				m.Cancel()
+			}
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Lock()
+		n := p.target - len(p.members) - p.pending
+		if n < 0 {
+			p.shrink(-n)
+			n = 0
+		}
+		p.pending += n
+		params := p.params
+		p.mu.Unlock()
+		if n == 0 {
+			continue
+		}
+		machines, err := p.b.Start(p.ctx, n, params...)
+		p.mu.Lock()
+		p.pending -= n
+		for _, m := range machines {
+			p.members[m] = true
+		}
+		if len(machines) > 0 {
+			p.notify()
+		}
+		p.mu.Unlock()
+		for _, m := range machines {
+			go p.watch(m)
+		}
+		switch {
+		case err != nil:
+			log.Error.Printf("pool: failed to start %d machines: %v", n, err)
+			if err := retry.Wait(p.ctx, poolRetryPolicy, retries); err != nil {
+				continue
+			}
+			retries++
+		case len(machines) < n:
+			retries = 0
+		default:
+			retries = 0
+			continue
+		}
+		// The system started fewer machines than requested (or none at
+		// all); try again for the remainder.
+		p.reconcile()
+	}
+}
+
+// shrink stops n of the pool's members, preferring those that are
+// not yet running. It must be called with p.mu held.
+func (p *Pool) shrink(n int) {
+	var running []*Machine
+	for m := range p.members {
+		if n == 0 {
+			return
+		}
+		if m.State() == Running {
+			running = append(running, m)
+			continue
+		}
+		delete(p.members, m)
+		p.stop(m)
+		n--
+	}
+	for _, m := range running {
+		if n == 0 {
+			break
+		}
+		delete(p.members, m)
+		p.stop(m)
+		n--
+	}
+	p.notify()
+}
+
+// stop gracefully stops machine m, which has been removed from the
+// pool, in the background.
+func (p *Pool) stop(m *Machine) {
+	go func() {
+		if err := m.Stop(p.ctx); err != nil {
+			log.Error.Printf("pool: failed to stop machine %s: %v", m.Addr, err)
+		}
+	}()
+}
+
+// watch maintains pool membership for machine m: it notifies
+// waiters when the machine becomes available, and removes it
+// (requesting a replacement) when it stops.
+func (p *Pool) watch(m *Machine) {
+	select {
+	case <-m.Wait(Running):
+		p.mu.Lock()
+		if p.members[m] {
+			p.notify()
+		}
+		p.mu.Unlock()
+	case <-p.ctx.Done():
+		return
+	}
+	select {
+	case <-m.Wait(Stopped):
+	case <-p.ctx.Done():
+		return
+	}
+	p.mu.Lock()
+	member := p.members[m]
+	if member {
+		delete(p.members, m)
+		p.notify()
+	}
+	if member && m.Failure() == FailureDiskFull {
+		m.mu.Lock()
+		size := m.diskFull.Total
+		m.mu.Unlock()
+		if params, ok := growDisk(p.params, size); ok {
+			log.Printf("pool: machine %s exhausted its disk; replacing with larger disks", m.Addr)
+			p.params = params
+		}
+	}
+	p.mu.Unlock()
+	if member {
+		log.Printf("pool: machine %s stopped: %v; replacing", m.Addr, m.Err())
+		p.reconcile()
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine_test
+
+import (
+	"context"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/grailbio/bigmachine"
+	"github.com/grailbio/bigmachine/testsystem"
+)
+
+func init() {
+	gob.Register(&poolService{})
+}
+
+type poolService struct{}
+
+func (*poolService) Ping(ctx context.Context, arg int, reply *int) error {
+	*reply = arg
+	return nil
+}
+
+func waitPool(t *testing.T, p *bigmachine.Pool, n int) []*bigmachine.Machine {
+	t.Helper()
+	deadline := time.After(30 * time.Second)
+	for {
+		changed := p.Changed()
+		if machines := p.Machines(); len(machines) == n {
+			return machines
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("timed out waiting for %d machines; have %d", n, len(p.Machines()))
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	test := testsystem.New()
+	test.KeepalivePeriod = time.Second
+	test.KeepaliveTimeout = 2 * time.Second
+	test.KeepaliveRpcTimeout = time.Second
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+
+	p := b.Pool(ctx, 2, bigmachine.Services{"Service": &poolService{}})
+	defer p.Close()
+	machines := waitPool(t, p, 2)
+	if !test.Kill(machines[0]) {
+		t.Fatal("failed to kill machine")
+	}
+	<-machines[0].Wait(bigmachine.Stopped)
+	machines = waitPool(t, p, 2)
+	for _, m := range machines {
+		var reply int
+		if err := m.Call(ctx, "Service.Ping", 1, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := test.N(), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	p.Resize(1)
+	waitPool(t, p, 1)
+	if got, want := p.Size(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
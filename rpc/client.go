@@ -7,7 +7,6 @@ package rpc
 import (
 	"bytes"
 	"context"
-	"encoding/gob"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -67,6 +66,19 @@ type Client struct {
 
 	mu      sync.Mutex
 	clients map[string]*clientState
+	// methodCodecs contains the codecs set by SetCodec, keyed by
+	// method or service name.
+	methodCodecs map[string]Codec
+	// methodEncodings contains the content encodings set by
+	// SetCompression, keyed by method or service name.
+	methodEncodings map[string]string
+	// sessionsEnabled is set when the client is in session mode (see
+	// EnableSessions). Sessions contains the client's sessions, keyed
+	// by address; noSessions the addresses of servers that do not
+	// support sessions.
+	sessionsEnabled bool
+	sessions        map[string]*clientSession
+	noSessions      map[string]bool
 }
 
 // NewClient creates a new RPC client.  clientFactory is called to create a new
@@ -80,6 +92,37 @@ func NewClient(clientFactory func() *http.Client, prefix string) (*Client, error
 	}, nil
 }
 
+// SetCodec sets the codec used to encode the arguments of, and to
+// request the replies from, calls to the provided method. If
+// serviceMethod names a service instead of a method ("Service"
+// instead of "Service.Method"), the codec is used for all of the
+// service's methods that do not have their own. Calls to other
+// methods use ProtobufCodec for values that implement proto.Message
+// and GobCodec otherwise.
+func (c *Client) SetCodec(serviceMethod string, codec Codec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.methodCodecs == nil {
+		c.methodCodecs = make(map[string]Codec)
+	}
+	c.methodCodecs[serviceMethod] = codec
+}
+
+// codecs returns the codecs used to encode the argument and to
+// decode the reply of a call to the provided method.
+func (c *Client) codecs(serviceMethod string, arg, reply interface{}) (argCodec, replyCodec Codec) {
+	c.mu.Lock()
+	codec, ok := c.methodCodecs[serviceMethod]
+	if !ok {
+		codec, ok = c.methodCodecs[strings.SplitN(serviceMethod, ".", 2)[0]]
+	}
+	c.mu.Unlock()
+	if ok {
+		return codec, codec
+	}
+	return typeCodec(arg), typeCodec(reply)
+}
+
 func (c *Client) getClient(addr string) *clientState {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -120,7 +163,8 @@ func (c *Client) getLogger(addr string) *rateLimitingOutputter {
 // registered service; Method names the method to invoke.
 //
 // The argument and reply are encoded in accordance with the
-// description of the package docs.
+// description of the package docs, by the codecs selected for the
+// method (see SetCodec).
 //
 // If the argument is an io.Reader, it is streamed directly to the
 // server method. In this case, Call does not return until the data
@@ -129,7 +173,15 @@ func (c *Client) getLogger(addr string) *rateLimitingOutputter {
 // returns once the stream is available, and the client is
 // responsible for fully reading the data and closing the reader. If
 // an error occurs while the response is streamed, the returned
-// io.ReadCloser errors on read.
+// io.ReadCloser errors on read. Similarly, if the reply is a
+// **StreamIterator, Call returns an iterator over the values
+// streamed by a method that replies over a channel (see CallStream),
+// and if the reply is a **Stream, Call opens a bidirectional stream
+// to a method that takes one (see OpenStream).
+//
+// If the method is set to be compressed (see SetCompression), the
+// argument is compressed, and the server is asked to compress the
+// reply.
 //
 // Remote errors are decoded into *errors.Error and returned.
 // (Non-*errors.Error errors are converted by the server.) The RPC
@@ -142,9 +194,14 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 	var (
 		requestBytes = -1
 		replyBytes   = -1
+		// wireRequestBytes and wireReplyBytes are the sizes of
+		// compressed payloads.
+		wireRequestBytes = -1
+		wireReplyBytes   = -1
 	)
 	defer func() {
 		done(int64(requestBytes), int64(replyBytes), err)
+		clientstats.compressed(serviceMethod, int64(wireRequestBytes), int64(wireReplyBytes))
 	}()
 	url := strings.TrimRight(addr, "/") + c.prefix + serviceMethod
 	if log.At(log.Debug) {
@@ -158,6 +215,27 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 			}
 		}()
 	}
+	if stream, ok := reply.(**Stream); ok {
+		*stream, err = c.openStream(ctx, addr, serviceMethod, arg)
+		return err
+	}
+	argCodec, replyCodec := c.codecs(serviceMethod, arg, reply)
+	encoding := c.compression(ctx, serviceMethod)
+	if encoding != "" && !supportedEncoding(encoding) {
+		return errors.E(errors.Fatal, errors.Invalid, fmt.Sprintf("unsupported content encoding %q", encoding))
+	}
+	if encoding == "" && canSession(arg, reply, argCodec, replyCodec) {
+		if sess := c.session(ctx, addr); sess != nil {
+			requestBytes, replyBytes, err = sess.call(ctx, serviceMethod, arg, reply)
+			if requestBytes > largeRpcPayload {
+				log.Outputf(largeArgLogger, log.Info, "call %s %s: large argument: %d bytes", addr, serviceMethod, requestBytes)
+			}
+			if replyBytes > largeRpcPayload {
+				log.Outputf(largeReplyLogger, log.Info, "call %s %s: large reply: %d bytes", addr, serviceMethod, replyBytes)
+			}
+			return err
+		}
+	}
 	var (
 		body        io.Reader
 		contentType string
@@ -166,25 +244,62 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 	case io.Reader:
 		body = arg
 		contentType = "application/octet-stream"
+		if encoding != "" {
+			r, w := io.Pipe()
+			go func() {
+				cw := newCompressor(encoding, w)
+				_, err := io.Copy(cw, arg)
+				if err == nil {
+					err = cw.Close()
+				}
+				w.CloseWithError(err)
+			}()
+			body = r
+		}
 	default:
 		b := new(bytes.Buffer)
-		enc := gob.NewEncoder(b)
-		if err := enc.Encode(arg); err != nil {
+		if err := argCodec.Encode(b, arg); err != nil {
 			// Because we are writing into a Buffer, any error we see is a
 			// failure to encode, which will not succeed on retry without
 			// intervention.
 			return errors.E(errors.Fatal, errors.Invalid, err)
 		}
 		requestBytes = b.Len()
+		body = b
+		contentType = argCodec.ContentType()
+		if encoding != "" {
+			p, err := compress(encoding, b.Bytes())
+			if err != nil {
+				return errors.E(errors.Fatal, errors.Invalid, err)
+			}
+			wireRequestBytes = len(p)
+			body = bytes.NewReader(p)
+		}
 		if requestBytes > largeRpcPayload {
-			log.Outputf(largeArgLogger, log.Info, "call %s %s: large argument: %d bytes", addr, serviceMethod, requestBytes)
+			if wireRequestBytes >= 0 {
+				log.Outputf(largeArgLogger, log.Info, "call %s %s: large argument: %d bytes (%d compressed)", addr, serviceMethod, requestBytes, wireRequestBytes)
+			} else {
+				log.Outputf(largeArgLogger, log.Info, "call %s %s: large argument: %d bytes", addr, serviceMethod, requestBytes)
+			}
 		}
-		body = b
-		contentType = gobContentType
+	}
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return errors.E(errors.Fatal, errors.Invalid, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", replyCodec.ContentType())
+	// We always set Accept-Encoding: otherwise the HTTP transport
+	// requests, and transparently decompresses, gzipped replies.
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+		req.Header.Set("Accept-Encoding", encoding)
+	} else {
+		req.Header.Set("Accept-Encoding", identity)
 	}
 
 	h := c.getClient(addr)
-	resp, err := ctxhttp.Post(ctx, h.Client(), url, contentType, body)
+	resp, err := ctxhttp.Do(ctx, h.Client(), req)
 	switch err {
 	case nil:
 	case context.DeadlineExceeded, context.Canceled:
@@ -197,17 +312,31 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 	if InjectFailures {
 		resp.Body = &rpcFaultInjector{label: fmt.Sprintf("%s(%s)", serviceMethod, addr), in: resp.Body}
 	}
+	var wireReader *sizeTrackingReader
+	if replyEncoding := resp.Header.Get("Content-Encoding"); replyEncoding != "" && replyEncoding != identity {
+		wireReader = &sizeTrackingReader{Reader: resp.Body}
+		resp.Body = decompressBody{newDecompressReader(replyEncoding, wireReader), resp.Body}
+	}
 	switch arg := reply.(type) {
-	case *io.ReadCloser:
+	case *io.ReadCloser, **StreamIterator:
 		switch {
 		case resp.StatusCode == methodErrorCode:
-			dec := gob.NewDecoder(resp.Body)
 			defer resp.Body.Close()
-			return decodeError(serviceMethod, dec)
+			return decodeError(serviceMethod, resp, resp.Body)
 		case resp.StatusCode == 200:
+			// The reply's sizes are known only once it has been read.
+			resp.Body = newStatsBody(serviceMethod, resp.Body, wireReader)
+			if it, ok := arg.(**StreamIterator); ok {
+				if contentType := resp.Header.Get("Content-Type"); contentType != gobStreamContentType {
+					_ = resp.Body.Close()
+					return errors.E(errors.Fatal, errors.Invalid, fmt.Sprintf("%s: method does not stream values (content type %q)", url, contentType))
+				}
+				*it = newStreamIterator(serviceMethod, resp)
+				break
+			}
 			// Wrap the actual response in a stream reader so that
 			// errors are propagated properly.
-			*arg = streamReader{resp}
+			*arg.(*io.ReadCloser) = streamReader{resp}
 		case 400 <= resp.StatusCode && resp.StatusCode < 500:
 			body, err := ioutil.ReadAll(resp.Body)
 			// Nothing to do if closing fails.
@@ -225,19 +354,25 @@ func (c *Client) Call(ctx context.Context, addr, serviceMethod string, arg, repl
 	default:
 		defer resp.Body.Close()
 		sizeReader := &sizeTrackingReader{Reader: resp.Body}
-		dec := gob.NewDecoder(sizeReader)
 		switch {
 		case resp.StatusCode == methodErrorCode:
-			return decodeError(serviceMethod, dec)
+			return decodeError(serviceMethod, resp, sizeReader)
 		case resp.StatusCode == 200:
-			err := dec.Decode(reply)
+			err := decodeReply(resp, sizeReader, reply)
 			if err != nil {
 				c.resetClient(h, serviceMethod, "error decoding reply")
 				err = errors.E(errors.Invalid, errors.Temporary, "error while decoding reply for "+serviceMethod, err)
 			}
 			replyBytes = sizeReader.Len()
+			if wireReader != nil {
+				wireReplyBytes = wireReader.Len()
+			}
 			if replyBytes > largeRpcPayload {
-				log.Outputf(largeReplyLogger, log.Info, "call %s %s: large reply: %d bytes", addr, serviceMethod, replyBytes)
+				if wireReplyBytes >= 0 {
+					log.Outputf(largeReplyLogger, log.Info, "call %s %s: large reply: %d bytes (%d compressed)", addr, serviceMethod, replyBytes, wireReplyBytes)
+				} else {
+					log.Outputf(largeReplyLogger, log.Info, "call %s %s: large reply: %d bytes", addr, serviceMethod, replyBytes)
+				}
 			}
 			return err
 		case 400 <= resp.StatusCode && resp.StatusCode < 500:
@@ -271,18 +406,92 @@ func (r streamReader) Close() error {
 	return r.Body.Close()
 }
 
+// A statsBody is the body of a streamed reply. It records the sizes
+// of the reply, as read and, if it was compressed, as transmitted, in
+// the client's stats once the body is exhausted or closed.
+type statsBody struct {
+	serviceMethod string
+	r             *sizeTrackingReader
+	body          io.Closer
+	// wire reads the compressed reply; it is nil if the reply was
+	// not compressed.
+	wire *sizeTrackingReader
+	once sync.Once
+}
+
+func newStatsBody(serviceMethod string, body io.ReadCloser, wire *sizeTrackingReader) *statsBody {
+	return &statsBody{
+		serviceMethod: serviceMethod,
+		r:             &sizeTrackingReader{Reader: body},
+		body:          body,
+		wire:          wire,
+	}
+}
+
+// Read implements io.Reader.
+func (b *statsBody) Read(p []byte) (n int, err error) {
+	n, err = b.r.Read(p)
+	if err == io.EOF {
+		b.record()
+	}
+	return
+}
+
+// Close implements io.Closer.
+func (b *statsBody) Close() error {
+	b.record()
+	return b.body.Close()
+}
+
+func (b *statsBody) record() {
+	b.once.Do(func() {
+		wireBytes := -1
+		if b.wire != nil {
+			wireBytes = b.wire.Len()
+		}
+		clientstats.streamed(b.serviceMethod, int64(b.r.Len()), int64(wireBytes))
+	})
+}
+
+// DecompressBody is the body of a compressed response: reads are
+// decompressed; Close closes the response body.
+type decompressBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (d decompressBody) Close() error {
+	return d.body.Close()
+}
+
 func truncatef(v interface{}) string {
 	b := limitbuf.NewLogger(512)
 	fmt.Fprint(b, v)
 	return b.String()
 }
 
-// decodeErrors decodes a serialized error from the codec stream dec. It wraps
-// errors with an errors.Remote so that callers can distinguish between errors
-// in the machinery to execute the RPC and errors returned by the RPC itself.
-func decodeError(serviceMethod string, dec *gob.Decoder) error {
+// decodeReply decodes the reply body r of the response resp into
+// reply, using the codec named by the response's content type. The
+// reply is discarded if reply is nil.
+func decodeReply(resp *http.Response, r io.Reader, reply interface{}) error {
+	codec, ok := lookupCodec(resp.Header.Get("Content-Type"))
+	if !ok {
+		return fmt.Errorf("unsupported content type %q", resp.Header.Get("Content-Type"))
+	}
+	if reply == nil {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	return codec.Decode(r, reply)
+}
+
+// decodeErrors decodes a serialized error from the body r of the response
+// resp. It wraps errors with an errors.Remote so that callers can distinguish
+// between errors in the machinery to execute the RPC and errors returned by
+// the RPC itself.
+func decodeError(serviceMethod string, resp *http.Response, r io.Reader) error {
 	e := new(errors.Error)
-	if err := dec.Decode(e); err != nil {
+	if err := decodeReply(resp, r, e); err != nil {
 		return errors.E(errors.Invalid, errors.Temporary, "error while decoding error for "+serviceMethod, err)
 	}
 	return errors.E(errors.Remote, e)
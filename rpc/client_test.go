@@ -6,11 +6,16 @@ package rpc
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/grailbio/base/errors"
+	"golang.org/x/sync/errgroup"
 )
 
 var fatalErr = errors.E(errors.Fatal)
@@ -60,6 +65,365 @@ func TestEncodeError(t *testing.T) {
 	}
 }
 
+// TestLatency verifies that client call latencies are tracked by
+// method.
+func TestLatency(t *testing.T) {
+	url, client := newTestClient(t)
+	if _, ok := Latency("Test.Latency", 0.5); ok {
+		t.Fatal("unexpected latency estimate")
+	}
+	for i := 0; i < minLatencySamples; i++ {
+		var reply string
+		if err := client.Call(context.Background(), url, "Test.Echo", "hello", &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	median, ok := Latency("Test.Echo", 0.5)
+	if !ok {
+		t.Fatal("no latency estimate")
+	}
+	max, _ := Latency("Test.Echo", 1)
+	if median <= 0 || median > max {
+		t.Errorf("bad latencies: median %s, max %s", median, max)
+	}
+}
+
+type testSessionService struct {
+	entered, canceled chan struct{}
+}
+
+func (s *testSessionService) Block(ctx context.Context, _ struct{}, _ *struct{}) error {
+	close(s.entered)
+	<-ctx.Done()
+	close(s.canceled)
+	return ctx.Err()
+}
+
+func (s *testSessionService) Teapot(ctx context.Context, _ struct{}, reply *teapot) error {
+	return nil
+}
+
+// teapot cannot be gob-encoded because it has no exported fields.
+type teapot struct {
+	unexported int
+}
+
+// TestSession verifies that calls are multiplexed over sessions, and
+// that they are isolated from each other.
+func TestSession(t *testing.T) {
+	svc := &testSessionService{make(chan struct{}), make(chan struct{})}
+	srv := NewServer()
+	srv.Register("Test", new(TestService))
+	srv.Register("Session", svc)
+	httpsrv := httptest.NewUnstartedServer(srv)
+	httpsrv.EnableHTTP2 = true
+	httpsrv.StartTLS()
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.EnableSessions()
+	ctx := context.Background()
+
+	var g errgroup.Group
+	for i := 0; i < 100; i++ {
+		msg := fmt.Sprint("hello ", i)
+		g.Go(func() error {
+			var reply string
+			if err := client.Call(ctx, httpsrv.URL, "Test.Echo", msg, &reply); err != nil {
+				return err
+			}
+			if reply != msg {
+				return fmt.Errorf("got %v, want %v", reply, msg)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	client.mu.Lock()
+	sess := client.sessions[httpsrv.URL]
+	client.mu.Unlock()
+	if sess == nil {
+		t.Fatal("no session")
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error)
+	go func() {
+		errc <- client.Call(cctx, httpsrv.URL, "Session.Block", struct{}{}, nil)
+	}()
+	<-svc.entered
+	cancel()
+	if got, want := <-errc, context.Canceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	<-svc.canceled
+
+	// Errors, and failures to encode or decode values, are isolated
+	// to their calls.
+	err = client.Call(ctx, httpsrv.URL, "Test.Error", "the error message", nil)
+	if !errors.Is(errors.Remote, err) || errors.Recover(err).Err.Error() != "the error message" {
+		t.Errorf("bad error %v", err)
+	}
+	for _, call := range []struct {
+		method string
+		arg    interface{}
+	}{
+		{"Test.Echo", teapot{}},
+		{"Test.Echo", 123},
+		{"Test.NoSuchMethod", "hello"},
+		{"Session.Teapot", struct{}{}},
+	} {
+		err := client.Call(ctx, httpsrv.URL, call.method, call.arg, nil)
+		if err == nil {
+			t.Errorf("%s(%v): expected error", call.method, call.arg)
+		} else if !errors.Match(fatalErr, err) {
+			t.Errorf("%s(%v): error %v is not fatal", call.method, call.arg, err)
+		}
+	}
+	var reply string
+	if err := client.Call(ctx, httpsrv.URL, "Test.Echo", "still here", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, "still here"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	client.mu.Lock()
+	if client.sessions[httpsrv.URL] != sess {
+		t.Error("session was not reused")
+	}
+	client.mu.Unlock()
+
+	// Failed sessions are replaced.
+	httpsrv.CloseClientConnections()
+	for {
+		client.mu.Lock()
+		current := client.sessions[httpsrv.URL]
+		client.mu.Unlock()
+		if current != sess {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := client.Call(ctx, httpsrv.URL, "Test.Echo", "new session", &reply); err != nil {
+		t.Fatal(err)
+	}
+	client.mu.Lock()
+	if client.sessions[httpsrv.URL] == sess {
+		t.Error("failed session was reused")
+	}
+	client.mu.Unlock()
+	httpsrv.CloseClientConnections()
+}
+
+// TestSessionEncoderBlocked verifies that session messages whose
+// writes are delayed by a preceding message may be abandoned.
+func TestSessionEncoderBlocked(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+	// The session's first message is written while it is created.
+	go r.Read(make([]byte, 1024))
+	enc, err := newSessionEncoder(w, nil, sessionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nobody reads the next message, so its write blocks.
+	go enc.Encode(context.Background(), sessionRequest{ID: 1, Method: "Test.Echo"}, "large")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := enc.Encode(ctx, sessionRequest{ID: 1, Cancel: true}, nil); err != context.DeadlineExceeded {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+// TestSessionUnsupported verifies that clients in session mode make
+// individual calls to servers that do not support sessions.
+func TestSessionUnsupported(t *testing.T) {
+	url, client := newTestClient(t)
+	client.EnableSessions()
+	for i := 0; i < 2; i++ {
+		var reply string
+		if err := client.Call(context.Background(), url, "Test.Echo", "hello", &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reply, "hello"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	client.mu.Lock()
+	unsupported := client.noSessions[url]
+	client.mu.Unlock()
+	if !unsupported {
+		t.Error("expected sessions to be unsupported")
+	}
+}
+
+type testDuplexService struct {
+	entered, canceled chan struct{}
+	flooded           int64
+}
+
+// Sum replies to each value received with the sum of the argument
+// and the values received so far.
+func (s *testDuplexService) Sum(ctx context.Context, sum int, stream *Stream) error {
+	for {
+		var v int
+		if err := stream.Recv(&v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if v < 0 {
+			return errors.E(errors.Precondition, "negative value")
+		}
+		sum += v
+		if err := stream.Send(sum); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *testDuplexService) Block(ctx context.Context, _ struct{}, stream *Stream) error {
+	close(s.entered)
+	var v int
+	err := stream.Recv(&v)
+	<-ctx.Done()
+	close(s.canceled)
+	return err
+}
+
+func (s *testDuplexService) Flood(ctx context.Context, _ struct{}, stream *Stream) error {
+	p := make([]byte, 1<<20)
+	for {
+		if err := stream.Send(p); err != nil {
+			return err
+		}
+		atomic.AddInt64(&s.flooded, 1)
+	}
+}
+
+// TestBidirectionalStream verifies that values can be exchanged in
+// both directions over the course of a call.
+func TestBidirectionalStream(t *testing.T) {
+	svc := &testDuplexService{entered: make(chan struct{}), canceled: make(chan struct{})}
+	srv := NewServer()
+	srv.Register("Test", new(TestService))
+	srv.Register("Duplex", svc)
+	httpsrv := httptest.NewUnstartedServer(srv)
+	httpsrv.EnableHTTP2 = true
+	httpsrv.StartTLS()
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	stream, err := client.OpenStream(ctx, httpsrv.URL, "Duplex.Sum", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 100
+	for i := 1; i <= 10; i++ {
+		if err := stream.Send(i); err != nil {
+			t.Fatal(err)
+		}
+		want += i
+		var got int
+		if err := stream.Recv(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if got, want := stream.Recv(&v), io.EOF; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors are returned by Recv, with their kinds.
+	stream, err = client.OpenStream(ctx, httpsrv.URL, "Duplex.Sum", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(-1); err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Recv(&v)
+	if !errors.Is(errors.Remote, err) || !errors.Is(errors.Precondition, errors.Recover(err).Err) {
+		t.Errorf("bad error %v", err)
+	}
+	stream.Close()
+
+	// Canceling the context cancels the method.
+	cctx, cancel := context.WithCancel(ctx)
+	stream, err = client.OpenStream(cctx, httpsrv.URL, "Duplex.Block", struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svc.entered
+	cancel()
+	<-svc.canceled
+	if err := stream.Recv(&v); err == nil {
+		t.Error("expected error")
+	}
+	stream.Close()
+
+	// The method cannot send faster than the client receives.
+	stream, err = client.OpenStream(ctx, httpsrv.URL, "Duplex.Flood", struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p []byte
+	if err := stream.Recv(&p); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&svc.flooded); n > 32 {
+		t.Errorf("sent %d unconsumed values", n)
+	}
+	for i := 0; i < 100; i++ {
+		if err := stream.Recv(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.Close()
+
+	// Other methods cannot be streamed.
+	_, err = client.OpenStream(ctx, httpsrv.URL, "Test.Echo", "hello")
+	if err == nil || !errors.Match(errors.E(errors.Fatal, errors.Invalid), err) {
+		t.Errorf("bad error %v", err)
+	}
+	httpsrv.CloseClientConnections()
+}
+
+// TestBidirectionalStreamUnsupported verifies that bidirectional
+// streams fail over HTTP/1.
+func TestBidirectionalStreamUnsupported(t *testing.T) {
+	srv := NewServer()
+	srv.Register("Duplex", new(testDuplexService))
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.OpenStream(context.Background(), httpsrv.URL, "Duplex.Sum", 0)
+	if err == nil || !errors.Match(errors.E(errors.Fatal, errors.NotSupported), err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
 // newTestClient returns the address of a server running the TestService and a
 // client for calling that server.
 func newTestClient(t *testing.T) (string, *Client) {
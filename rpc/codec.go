@@ -0,0 +1,250 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	jsonContentType     = "application/json"
+	protobufContentType = "application/x-protobuf"
+)
+
+// A Codec encodes and decodes the arguments, replies, and errors of
+// RPC calls. Each codec is identified by the MIME type of its
+// encoding: clients name the codec of an argument by the request's
+// Content-Type header, and the codec in which they wish to receive
+// the reply by its Accept header.
+type Codec interface {
+	// ContentType returns the MIME type of the codec's encoding.
+	ContentType() string
+	// Encode writes the encoding of the value v to w.
+	Encode(w io.Writer, v interface{}) error
+	// Decode decodes a value from r into v, which is a pointer.
+	Decode(r io.Reader, v interface{}) error
+}
+
+var (
+	// GobCodec encodes values with package encoding/gob. It is the
+	// default codec.
+	GobCodec Codec = gobCodec{}
+	// JSONCodec encodes values with package encoding/json. Protocol
+	// buffer messages are encoded in their canonical JSON mapping.
+	JSONCodec Codec = jsonCodec{}
+	// ProtobufCodec encodes protocol buffer messages in their binary
+	// wire format. It can encode only values that implement
+	// proto.Message.
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		gobContentType:      GobCodec,
+		jsonContentType:     JSONCodec,
+		protobufContentType: ProtobufCodec,
+	}
+)
+
+// RegisterCodec registers the provided codec with its content type,
+// so that servers accept arguments in, and reply with, its encoding.
+// A codec previously registered with the same content type is
+// replaced.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	codecs[codec.ContentType()] = codec
+	codecsMu.Unlock()
+}
+
+// lookupCodec returns the registered codec for the provided
+// Content-Type header. Requests and replies without a content type
+// use GobCodec.
+func lookupCodec(contentType string) (Codec, bool) {
+	if contentType == "" {
+		return GobCodec, true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	codecsMu.RLock()
+	codec, ok := codecs[mediaType]
+	codecsMu.RUnlock()
+	return codec, ok
+}
+
+// negotiateCodec returns the first registered codec named by the
+// provided Accept header, or nil if there is none.
+func negotiateCodec(accept string) Codec {
+	if accept == "" {
+		return nil
+	}
+	for _, contentType := range strings.Split(accept, ",") {
+		if codec, ok := lookupCodec(strings.TrimSpace(contentType)); ok {
+			return codec
+		}
+	}
+	return nil
+}
+
+// typeCodec returns the codec used for values of v's type unless
+// the method's codec is set explicitly: protocol buffer messages use
+// ProtobufCodec; all other values use GobCodec.
+func typeCodec(v interface{}) Codec {
+	if _, ok := v.(proto.Message); ok {
+		return ProtobufCodec
+	}
+	return GobCodec
+}
+
+// encodeReply encodes the reply v, or the error v if isErr is set,
+// into b. Not every codec can represent errors (protocol buffers,
+// for example, cannot): errors that fail to encode with the provided
+// codec are encoded with JSONCodec instead. EncodeReply returns the
+// codec that was used.
+func encodeReply(b *bytes.Buffer, codec Codec, v interface{}, isErr bool) (Codec, error) {
+	err := codec.Encode(b, v)
+	if err != nil && isErr && codec != JSONCodec {
+		b.Reset()
+		codec = JSONCodec
+		err = codec.Encode(b, v)
+	}
+	return codec, err
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return gobContentType }
+
+func (gobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return jsonContentType }
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	switch v := v.(type) {
+	case *errors.Error:
+		return json.NewEncoder(w).Encode(toJSONError(v))
+	case proto.Message:
+		p, err := protojson.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(p)
+		return err
+	default:
+		return json.NewEncoder(w).Encode(v)
+	}
+}
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	switch v := v.(type) {
+	case *errors.Error:
+		var je jsonError
+		if err := json.NewDecoder(r).Decode(&je); err != nil {
+			return err
+		}
+		*v = *je.toError()
+		return nil
+	case proto.Message:
+		p, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return protojson.Unmarshal(p, v)
+	default:
+		return json.NewDecoder(r).Decode(v)
+	}
+}
+
+// A jsonError is the JSON representation of an *errors.Error. As in
+// the error's gob encoding, underlying errors that are not
+// *errors.Errors are replaced by their error strings.
+type jsonError struct {
+	Kind     errors.Kind
+	Severity errors.Severity
+	Message  string     `json:",omitempty"`
+	Next     *jsonError `json:",omitempty"`
+	Err      string     `json:",omitempty"`
+}
+
+func toJSONError(e *errors.Error) *jsonError {
+	je := &jsonError{
+		Kind:     e.Kind,
+		Severity: e.Severity,
+		Message:  e.Message,
+	}
+	switch err := e.Err.(type) {
+	case nil:
+	case *errors.Error:
+		je.Next = toJSONError(err)
+	default:
+		je.Err = err.Error()
+	}
+	return je
+}
+
+func (je *jsonError) toError() *errors.Error {
+	e := &errors.Error{
+		Kind:     je.Kind,
+		Severity: je.Severity,
+		Message:  je.Message,
+	}
+	if je.Next != nil {
+		e.Err = je.Next.toError()
+	} else if je.Err != "" {
+		e.Err = errors.New(je.Err)
+	}
+	return e
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return protobufContentType }
+
+func (protobufCodec) Encode(w io.Writer, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	p, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(p)
+	return err
+}
+
+func (protobufCodec) Decode(r io.Reader, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(p, m)
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Content encodings with which calls may be compressed (see
+// (*Client).SetCompression).
+const (
+	// Gzip compresses payloads with gzip (package compress/gzip).
+	Gzip = "gzip"
+	// Deflate compresses payloads with DEFLATE (package
+	// compress/flate), in the zlib format required by HTTP's
+	// "deflate" content coding.
+	Deflate = "deflate"
+
+	// identity is the content encoding of uncompressed payloads.
+	identity = "identity"
+)
+
+// supportedEncoding tells whether the provided content encoding is
+// supported.
+func supportedEncoding(encoding string) bool {
+	return encoding == Gzip || encoding == Deflate
+}
+
+// A compressor compresses the data written to it. Flush writes any
+// pending data to the underlying writer; Close also writes the
+// compressed stream's footer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newCompressor returns a compressor for the provided (supported)
+// content encoding that writes to w.
+func newCompressor(encoding string, w io.Writer) compressor {
+	switch encoding {
+	case Gzip:
+		return gzip.NewWriter(w)
+	case Deflate:
+		return zlib.NewWriter(w)
+	default:
+		panic("unsupported content encoding " + encoding)
+	}
+}
+
+// compress compresses p with the provided content encoding.
+func compress(encoding string, p []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := newCompressor(encoding, &b)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// A decompressReader decompresses the data read from an underlying
+// reader. The decompressor is created on first read, so that
+// creating a decompressReader does not block on the stream's
+// header.
+type decompressReader struct {
+	encoding string
+	r        io.Reader
+	dec      io.Reader
+}
+
+func newDecompressReader(encoding string, r io.Reader) *decompressReader {
+	return &decompressReader{encoding: encoding, r: r}
+}
+
+// Read implements io.Reader.
+func (d *decompressReader) Read(p []byte) (n int, err error) {
+	if d.dec == nil {
+		switch d.encoding {
+		case Gzip:
+			d.dec, err = gzip.NewReader(d.r)
+		case Deflate:
+			d.dec, err = zlib.NewReader(d.r)
+		default:
+			err = fmt.Errorf("unsupported content encoding %q", d.encoding)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	return d.dec.Read(p)
+}
+
+// A compressWriter is a compressor that writes to an HTTP response.
+// Flushing the compressWriter also flushes the response, if it can
+// be flushed.
+type compressWriter struct {
+	compressor
+	w io.Writer
+}
+
+// Flush implements http.Flusher.
+func (c *compressWriter) Flush() {
+	if err := c.compressor.Flush(); err != nil {
+		return
+	}
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// negotiateEncoding returns the first supported content encoding
+// accepted by the provided Accept-Encoding header, or "" if there
+// is none. Encodings with a quality of zero are not accepted.
+func negotiateEncoding(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		var params string
+		if i := strings.Index(part, ";"); i >= 0 {
+			part, params = part[:i], part[i+1:]
+		}
+		encoding := strings.ToLower(strings.TrimSpace(part))
+		if !supportedEncoding(encoding) {
+			continue
+		}
+		if q := strings.Replace(params, " ", "", -1); strings.HasPrefix(q, "q=0") && strings.Trim(q[3:], ".0") == "" {
+			continue
+		}
+		return encoding
+	}
+	return ""
+}
+
+type compressionKey struct{}
+
+// WithCompression returns a context that compresses the calls made
+// with it with the provided content encoding, overriding the
+// compression set for their methods by (*Client).SetCompression. An
+// empty encoding disables compression.
+func WithCompression(ctx context.Context, encoding string) context.Context {
+	return context.WithValue(ctx, compressionKey{}, encoding)
+}
+
+// SetCompression sets the content encoding (Gzip or Deflate) with
+// which calls to the provided method are compressed. If
+// serviceMethod names a service instead of a method ("Service"
+// instead of "Service.Method"), calls to all of the service's
+// methods that do not have their own encoding are compressed. An
+// empty encoding disables compression.
+//
+// Compressed calls compress their arguments, whether they are
+// encoded values or byte streams, and request that the server
+// compress their replies; the server compresses replies only if it
+// supports the encoding. Compression is negotiated with HTTP's
+// Content-Encoding and Accept-Encoding headers. Calls are otherwise
+// uncompressed. Calls made over sessions, and bidirectional streams,
+// are never compressed: compressed calls bypass sessions.
+func (c *Client) SetCompression(serviceMethod, encoding string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.methodEncodings == nil {
+		c.methodEncodings = make(map[string]string)
+	}
+	c.methodEncodings[serviceMethod] = encoding
+}
+
+// compression returns the content encoding with which a call to the
+// provided method, made with the provided context, is compressed. It
+// returns "" if the call is not compressed.
+func (c *Client) compression(ctx context.Context, serviceMethod string) string {
+	if encoding, ok := ctx.Value(compressionKey{}).(string); ok {
+		return encoding
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	encoding, ok := c.methodEncodings[serviceMethod]
+	if !ok {
+		encoding = c.methodEncodings[strings.SplitN(serviceMethod, ".", 2)[0]]
+	}
+	return encoding
+}
@@ -0,0 +1,277 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+)
+
+var typeOfStream = reflect.TypeOf((*Stream)(nil))
+
+// A Stream is a bidirectional stream of gob-encoded values between
+// a client and a method of the form
+//
+//	Func(ctx context.Context, arg argType, stream *rpc.Stream) error
+//
+// Streams are carried by full-duplex HTTP/2 streams: each side may
+// send and receive values while the call is in progress, in any
+// order. Sends block while the peer is not consuming values, so that
+// the receiver regulates the sender. Send and Recv may be called
+// concurrently with each other.
+//
+// The client opens a stream with (*Client).OpenStream, or by Call
+// with a **Stream reply. Once the method returns, the client's Recv
+// returns the method's error, if any, and io.EOF otherwise; the
+// client's subsequent sends fail. The client must close the stream
+// once it is done with it. The method's Recv returns io.EOF once the
+// client has called CloseSend.
+type Stream struct {
+	serviceMethod string
+
+	sendMu sync.Mutex
+	enc    *gob.Encoder
+	w      *sizeTrackingWriter
+	flush  func()
+
+	recvMu sync.Mutex
+	dec    *gob.Decoder
+	r      *sizeTrackingReader
+	// err is the error that ended the stream's receives.
+	err error
+
+	// body, resp, and cancel are set for the client's side of the
+	// stream.
+	body   *io.PipeWriter
+	resp   *http.Response
+	cancel context.CancelFunc
+}
+
+func newStream(serviceMethod string, w io.Writer, flush func()) *Stream {
+	s := &Stream{
+		serviceMethod: serviceMethod,
+		w:             &sizeTrackingWriter{Writer: w},
+		flush:         flush,
+	}
+	s.enc = gob.NewEncoder(s.w)
+	return s
+}
+
+// setReader sets the reader from which the stream's values are
+// received.
+func (s *Stream) setReader(r io.Reader) {
+	s.r = &sizeTrackingReader{Reader: r}
+	s.dec = gob.NewDecoder(s.r)
+}
+
+// Send sends a value to the stream's peer. Send blocks until the
+// value has been written to the stream, which in turn waits for the
+// peer to consume previously sent values.
+func (s *Stream) Send(v interface{}) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if err := s.enc.Encode(v); err != nil {
+		return errors.E("error while sending to stream for "+s.serviceMethod, err)
+	}
+	if s.flush != nil {
+		s.flush()
+	}
+	return nil
+}
+
+// Recv receives the next value from the stream's peer into v, which
+// must be a pointer to a value of the type sent by the peer. Recv
+// returns io.EOF once the peer has finished sending. On the client,
+// Recv instead returns the method's error, if it returned one; such
+// errors are of kind errors.Remote, as they are for Call.
+func (s *Stream) Recv(v interface{}) error {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	resetValue(v)
+	err := s.dec.Decode(v)
+	if err == nil {
+		return nil
+	}
+	switch {
+	case err != io.EOF:
+		err = errors.E("error while reading stream for "+s.serviceMethod, err)
+	case s.resp != nil:
+		if e := decodeStreamError(s.serviceMethod, s.resp.Trailer.Get(bigmachineErrorTrailer)); e != nil {
+			err = e
+		}
+	}
+	s.err = err
+	return err
+}
+
+// CloseSend indicates to the method that the client has finished
+// sending values. It is a no-op on the method's side of the stream,
+// whose sends end when the method returns.
+func (s *Stream) CloseSend() error {
+	if s.body == nil {
+		return nil
+	}
+	return s.body.Close()
+}
+
+// Close closes the client's side of the stream, canceling the
+// method if it has not yet returned. It is a no-op on the method's
+// side of the stream.
+func (s *Stream) Close() error {
+	if s.resp == nil {
+		return nil
+	}
+	s.cancel()
+	return nil
+}
+
+// resetValue resets the value pointed to by v to its zero value.
+// Gob does not transmit zero fields: values must be reset before
+// they are decoded so that they are not left over from previous
+// values.
+func resetValue(v interface{}) {
+	if ptr := reflect.ValueOf(v); ptr.Kind() == reflect.Ptr && !ptr.IsNil() {
+		ptr.Elem().Set(reflect.Zero(ptr.Elem().Type()))
+	}
+}
+
+// OpenStream opens a bidirectional stream to a method that takes a
+// *Stream (see Stream). The argument is sent as the stream's first
+// value. OpenStream returns once the method has been invoked. The
+// stream is canceled when the provided context is done.
+func (c *Client) OpenStream(ctx context.Context, addr, serviceMethod string, arg interface{}) (*Stream, error) {
+	var stream *Stream
+	if err := c.Call(ctx, addr, serviceMethod, arg, &stream); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// openStream opens a bidirectional stream for Call.
+func (c *Client) openStream(ctx context.Context, addr, serviceMethod string, arg interface{}) (*Stream, error) {
+	url := strings.TrimRight(addr, "/") + c.prefix + serviceMethod
+	r, w := io.Pipe()
+	req, err := http.NewRequest("POST", url, r)
+	if err != nil {
+		return nil, errors.E(errors.Fatal, errors.Invalid, err)
+	}
+	req.Header.Set("Content-Type", gobStreamContentType)
+	req.Header.Set("Accept", gobStreamContentType)
+	stream := newStream(serviceMethod, w, nil)
+	// The argument is sent while the request is made: servers that do
+	// not support bidirectional streams may read it before they reply.
+	sent := make(chan error, 1)
+	go func() {
+		sent <- stream.Send(arg)
+	}()
+	h := c.getClient(addr)
+	streamCtx, cancel := context.WithCancel(ctx)
+	resp, err := h.Client().Do(req.WithContext(streamCtx))
+	if err != nil {
+		cancel()
+		w.CloseWithError(err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			c.resetClient(h, serviceMethod, "deadline exceeded or cancelled")
+			return nil, ctxErr
+		}
+		c.resetClient(h, serviceMethod, "temporary network error")
+		return nil, errors.E(errors.Net, errors.Temporary, err)
+	}
+	if resp.StatusCode != 200 {
+		defer cancel()
+		defer resp.Body.Close()
+		// The server does not read the rest of the stream when it fails
+		// the call.
+		w.Close()
+		if resp.StatusCode == methodErrorCode {
+			return nil, decodeError(serviceMethod, resp, resp.Body)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		switch {
+		case resp.StatusCode == http.StatusHTTPVersionNotSupported:
+			return nil, errors.E(errors.Fatal, errors.NotSupported, fmt.Sprintf("%s: bidirectional streams require HTTP/2", url))
+		case 400 <= resp.StatusCode && resp.StatusCode < 500:
+			c.resetClient(h, serviceMethod, fmt.Sprintf("%s: client error %s, %v, %v", url, resp.Status, string(body), err))
+			return nil, errors.E(errors.Fatal, errors.Invalid, fmt.Sprintf("%s: client error %s", url, resp.Status))
+		default:
+			c.resetClient(h, serviceMethod, fmt.Sprintf("%s: bad reply status %s, %v, %v", url, resp.Status, string(body), err))
+			return nil, errors.E(errors.Invalid, errors.Temporary, fmt.Sprintf("%s: bad reply status %s", url, resp.Status))
+		}
+	}
+	stream.setReader(resp.Body)
+	stream.body, stream.resp, stream.cancel = w, resp, cancel
+	// The transport does not otherwise notice that the context is done
+	// while the stream is idle.
+	go func() {
+		<-streamCtx.Done()
+		w.CloseWithError(streamCtx.Err())
+		resp.Body.Close()
+	}()
+	if contentType := resp.Header.Get("Content-Type"); contentType != gobStreamContentType {
+		stream.Close()
+		return nil, errors.E(errors.Fatal, errors.Invalid, fmt.Sprintf("%s: method is not bidirectional (content type %q)", url, contentType))
+	}
+	if err := <-sent; err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// serveDuplex serves a call to a method that takes a *Stream. The
+// response is written, and flushed, before the method is invoked, so
+// that the client can begin to send values; the method's argument
+// is the first value of the request body. Once the method returns,
+// its error, if any, is set in the response trailer. Bidirectional
+// streams require full-duplex streams, and thus HTTP/2.
+func (s *Server) serveDuplex(ctx context.Context, w http.ResponseWriter, r *http.Request, svc *service, m *method) {
+	flusher, ok := w.(http.Flusher)
+	if r.ProtoMajor < 2 || !ok {
+		// As with sessions, the client does not close the request body
+		// until it receives the reply.
+		w.Header().Set("Connection", "close")
+		http.Error(w, "bidirectional streams require HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	defer r.Body.Close()
+	if !s.enter(svc.name) {
+		writeError(w, GobCodec, errors.E(errors.Unavailable, errors.Temporary, "server is draining"))
+		return
+	}
+	defer s.exit(svc.name)
+	serviceMethod := svc.name + "." + m.method.Name
+	stream := newStream(serviceMethod, w, flusher.Flush)
+	stream.setReader(r.Body)
+	var err error
+	done := serverstats.Start("", serviceMethod)
+	defer func() {
+		done(int64(stream.r.Len()), int64(stream.w.Len()), err)
+	}()
+	w.Header().Set("Content-Type", gobStreamContentType)
+	w.Header().Set("Trailer", bigmachineErrorTrailer)
+	w.WriteHeader(200)
+	flusher.Flush()
+	argv, ptr := m.newArg()
+	if err = stream.Recv(ptr.Interface()); err != nil {
+		err = errors.E(errors.Invalid, "error decoding request", err)
+	} else {
+		err = svc.call(ctx, m, argv, reflect.ValueOf(stream))
+	}
+	// This is required because of a bug in net/http2 that causes the
+	// connection to hang when pre-declared trailers are not set.
+	w.Header().Set(bigmachineErrorTrailer, encodeStreamError(err))
+}
@@ -7,14 +7,20 @@
 //
 //	Func(ctx context.Context, arg argType, reply *replyType) error
 //
+// or, for methods that stream their replies as a sequence of values:
+//
+//	Func(ctx context.Context, arg argType, reply chan<- replyType) error
+//
 // By default, the values are Gob-encoded, with the following
 // exceptions:
 //	- if argType is io.Reader, a direct byte stream is provided
 //	- if replyType is io.ReadCloser, a direct byte stream is provided
-// In the future, the package will also support custom codecs, so
-// that, for example, if the argument or reply is generated by a
-// protocol buffer, then protocol buffer encoding is used
-// automatically.
+//	- if argType or replyType implements proto.Message, the value is
+//	  encoded as a protocol buffer
+// Other encodings are provided by codecs (see Codec). The package
+// provides gob, JSON, and protocol buffer codecs, and others may be
+// registered with RegisterCodec. Clients may select the codec used
+// for a method's values with (*Client).SetCodec.
 //
 // Every value is registered with a name. This name is used by the
 // client to specify the object on which to dispatch methods.
@@ -27,26 +33,58 @@
 // Each method registered by a server receives its own URL endpoint:
 // Service.Method. Calls to a method are performed as HTTP POST
 // requests to that method's endpoint. The HTTP body contains a
-// gob-encoded (package encoding/gob) stream of data interpreted as
-// the method's argument. In the case where the method's argument is
-// an io.Reader, the body instead passed through. The reply body
-// contains the reply, also gob-encoded, except when the reply has
+// stream of data interpreted as the method's argument, encoded by
+// the codec named by the request's Content-Type header; requests
+// without a Content-Type are gob-encoded (package encoding/gob). In
+// the case where the method's argument is an io.Reader, the body
+// instead passed through. The reply body contains the reply, encoded
+// by the first registered codec named in the request's Accept
+// header, or else by the request's codec, except when the reply has
 // type io.ReadCloser in which case the body is passed through and
-// streamed end-to-end.
+// streamed end-to-end. Servers can thus be called by any client that
+// speaks one of their codecs, for example with JSON.
+//
+// Request bodies may be compressed, as indicated by their
+// Content-Encoding header. Replies, including streamed replies, are
+// compressed with the first supported encoding named by the
+// request's Accept-Encoding header, if any; error replies are not
+// compressed. Gzip and DEFLATE are supported. Clients compress calls
+// only when asked to (see (*Client).SetCompression).
 //
 // On successful invocation, HTTP code 200 is returned. When a method
 // invocation returns an error, HTTP code 590 is returned. In this
-// case, the error message is gob-encoded as the reply body.
+// case, the error is encoded as the reply body: by the reply's codec
+// if it can represent errors, and as JSON otherwise.
+//
+// Methods that reply over a channel stream the values they send: the
+// reply body is a single gob stream of the values, written as they
+// are sent and read by the client as they are consumed (see
+// CallStream). Methods should stop sending once their context is
+// done, and must not close the channel: it is closed by the server
+// when the method returns. The method's error, if any, is returned
+// in the x-bigmachine-error trailer, as it is for byte streams.
+//
+// Methods of the form
+//
+//	Func(ctx context.Context, arg argType, stream *rpc.Stream) error
+//
+// are served over bidirectional streams, which require HTTP/2: the
+// client and the method exchange gob-encoded values over a single
+// full-duplex stream for the duration of the call (see Stream). The
+// argument is the first value sent by the client, and the method's
+// error is returned in the x-bigmachine-error trailer.
 //
-// At the moment, a new gob encoder is created for each call. This is
-// inefficient for small requests and replies. Future work includes
-// maintaining long-running gob codecs to avoid these inefficiences.
+// By default, a new gob encoder is created for each call. This is
+// inefficient for small requests and replies, as type descriptors
+// are sent with every call. Clients in session mode (see
+// (*Client).EnableSessions) instead multiplex their calls to each
+// server over a single full-duplex HTTP/2 stream, whose long-lived
+// gob encoders send each type descriptor only once.
 package rpc
 
 import (
 	"bytes"
 	"context"
-	"encoding/gob"
 	"fmt"
 	"io"
 	"net/http"
@@ -81,6 +119,11 @@ var (
 type method struct {
 	method     reflect.Method
 	arg, reply reflect.Type
+	// stream is set if the method streams its replies over a
+	// channel.
+	stream bool
+	// duplex is set if the method takes a bidirectional stream.
+	duplex bool
 }
 
 // A service is a collection of methods invoked on the same receiver value.
@@ -99,7 +142,6 @@ func (s *service) Init() error {
 	//	Func(context.Context, argType, *replyType) error
 	//
 	// TODO: special cases
-	//	- ProtoMessage()
 	//	- Vanadium structs?
 	// TODO: provide better ergonomics here, e.g., report methods
 	// that are almost RPC methods, but don't match one or two of
@@ -118,7 +160,9 @@ func (s *service) Init() error {
 			continue
 		}
 		// TODO: m.Type(2): check that it's exported or builtin
-		if m.Type.In(3).Kind() != reflect.Ptr {
+		reply := m.Type.In(3)
+		stream := reply.Kind() == reflect.Chan && reply.ChanDir()&reflect.SendDir != 0
+		if reply.Kind() != reflect.Ptr && !stream {
 			continue
 		}
 		if m.Type.NumOut() != 1 {
@@ -127,27 +171,90 @@ func (s *service) Init() error {
 		if m.Type.Out(0) != typeOfError {
 			continue
 		}
+		duplex := reply == typeOfStream
+		// The arguments of bidirectional streams are sent over the
+		// stream, and thus cannot themselves be streams.
+		if duplex && m.Type.In(2) == typeOfReader {
+			continue
+		}
 		s.methods[m.Name] = &method{
 			method: m,
 			arg:    m.Type.In(2),
-			reply:  m.Type.In(3),
+			reply:  reply,
+			stream: stream,
+			duplex: duplex,
 		}
 	}
 	return nil
 }
 
+// newArg returns a new value of the method's argument type, and the
+// pointer into which the argument is decoded.
+func (m *method) newArg() (argv, ptr reflect.Value) {
+	if m.arg.Kind() == reflect.Ptr {
+		argv = reflect.New(m.arg.Elem())
+		return argv, argv
+	}
+	ptr = reflect.New(m.arg)
+	return ptr.Elem(), ptr
+}
+
+// newReply returns a pointer to a new value of the method's reply
+// type, into which the method writes its reply.
+func (m *method) newReply() reflect.Value {
+	replyv := reflect.New(m.reply.Elem())
+	switch m.reply.Elem().Kind() {
+	case reflect.Map:
+		replyv.Elem().Set(reflect.MakeMap(m.reply.Elem()))
+	case reflect.Slice:
+		replyv.Elem().Set(reflect.MakeSlice(m.reply.Elem(), 0, 0))
+	}
+	return replyv
+}
+
+// call invokes the service's method m with the provided argument and
+// reply, returning its error. Panics in the method are recovered and
+// returned as errors.
+func (svc *service) call(ctx context.Context, m *method, argv, replyv reflect.Value) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Error.Printf("panic in method call %s.%s\n%s", svc.name, m.method.Name, string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+	rvs := m.method.Func.Call([]reflect.Value{svc.recv, reflect.ValueOf(ctx), argv, replyv})
+	if e := rvs[0].Interface(); e != nil {
+		err = e.(error)
+	}
+	return
+}
+
 // A Server dispatches methods on collection of registered objects.
 // Its dispatch rules are described in the package docs. Server
 // implements http.Handler and can be served by any HTTP server.
 type Server struct {
 	mu       sync.RWMutex
 	services map[string]*service
+
+	// callMu protects the following fields, which are used to track
+	// pending calls and to drain the server.
+	callMu sync.Mutex
+	// pending is the number of pending calls, by service.
+	pending map[string]int
+	// draining is set when the server is draining; exempt
+	// contains the services that continue to be served.
+	draining bool
+	exempt   map[string]bool
+	// drained is closed when a draining server has no more
+	// pending calls to non-exempt services.
+	drained chan struct{}
 }
 
 // NewServer returns a new, initialized, Server.
 func NewServer() *Server {
 	return &Server{
 		services: make(map[string]*service),
+		pending:  make(map[string]int),
 	}
 }
 
@@ -187,6 +294,10 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", 405)
 		return
 	}
+	if path.Base(r.URL.Path) == sessionEndpoint {
+		s.serveSession(w, r)
+		return
+	}
 	ctx := backgroundcontext.Wrap(r.Context())
 	parts := strings.SplitN(path.Base(r.URL.Path), ".", 2)
 	if len(parts) != 2 {
@@ -194,78 +305,100 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	service, method := parts[0], parts[1]
-	s.mu.RLock()
-	svc := s.services[service]
-	s.mu.RUnlock()
+	svc, m := s.lookup(service, method)
 	if svc == nil {
 		http.Error(w, "no such service", 404)
 		return
 	}
-	m := svc.methods[method]
 	if m == nil {
 		http.Error(w, "no such method", 404)
 		return
 	}
+	if m.duplex {
+		s.serveDuplex(ctx, w, r, svc, m)
+		return
+	}
 	defer r.Body.Close()
+	// The argument is decoded by the codec named by the request's
+	// content type; the reply is encoded by the codec that the client
+	// accepts, or else by the argument's codec.
+	var argCodec Codec = GobCodec
+	if m.arg != typeOfReader {
+		var ok bool
+		argCodec, ok = lookupCodec(r.Header.Get("Content-Type"))
+		if !ok {
+			http.Error(w, fmt.Sprintf("unsupported content type %q", r.Header.Get("Content-Type")), 415)
+			return
+		}
+	}
+	replyCodec := negotiateCodec(r.Header.Get("Accept"))
+	if replyCodec == nil {
+		replyCodec = argCodec
+	}
+	// Compressed requests are decompressed as they are read; replies
+	// are compressed with the first supported encoding accepted by the
+	// client, if any.
+	var (
+		body       io.Reader = r.Body
+		wireReader *sizeTrackingReader
+	)
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != identity {
+		if !supportedEncoding(encoding) {
+			http.Error(w, fmt.Sprintf("unsupported content encoding %q", encoding), 415)
+			return
+		}
+		wireReader = &sizeTrackingReader{Reader: r.Body}
+		body = newDecompressReader(encoding, wireReader)
+	}
+	replyEncoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if !s.enter(service) {
+		writeError(w, replyCodec, errors.E(errors.Unavailable, errors.Temporary, "server is draining"))
+		return
+	}
+	defer s.exit(service)
 	var (
 		err          error
 		requestBytes = -1
 		replyBytes   = -1
+		// wireRequestBytes and wireReplyBytes are the sizes of
+		// compressed payloads.
+		wireRequestBytes = -1
+		wireReplyBytes   = -1
 	)
 	done := serverstats.Start("", service+"."+method)
 	defer func() {
 		done(int64(requestBytes), int64(replyBytes), err)
+		serverstats.compressed(service+"."+method, int64(wireRequestBytes), int64(wireReplyBytes))
 	}()
 	// Read the request.
 	var argv reflect.Value
 	if m.arg == typeOfReader {
 		// Readers get the body straight.
-		argv = reflect.ValueOf(r.Body)
+		argv = reflect.ValueOf(body)
 	} else {
-		if m.arg.Kind() == reflect.Ptr {
-			argv = reflect.New(m.arg.Elem())
-		} else {
-			argv = reflect.New(m.arg)
-		}
-		sizeReader := &sizeTrackingReader{Reader: r.Body}
-		dec := gob.NewDecoder(sizeReader)
+		var ptr reflect.Value
+		argv, ptr = m.newArg()
+		sizeReader := &sizeTrackingReader{Reader: body}
+		err = argCodec.Decode(sizeReader, ptr.Interface())
 		requestBytes = sizeReader.Len()
-		if err = dec.Decode(argv.Interface()); err != nil {
+		if wireReader != nil {
+			wireRequestBytes = wireReader.Len()
+		}
+		if err != nil {
 			http.Error(w, fmt.Sprintf("error decoding request: %v", err), 400)
 			return
 		}
-		if m.arg.Kind() != reflect.Ptr {
-			argv = argv.Elem()
-		}
 	}
-	var (
-		replyv     reflect.Value
-		readcloser io.ReadCloser
-	)
+	if m.stream {
+		replyBytes, wireReplyBytes, err = serveStream(ctx, w, svc, m, argv, replyEncoding)
+		return
+	}
+	replyv := m.newReply()
+	err = svc.call(ctx, m, argv, replyv)
+	var readcloser io.ReadCloser
 	if m.reply.Elem() == typeOfReadCloser {
-		replyv = reflect.ValueOf(&readcloser)
-	} else {
-		replyv = reflect.New(m.reply.Elem())
-		switch m.reply.Elem().Kind() {
-		case reflect.Map:
-			replyv.Elem().Set(reflect.MakeMap(m.reply.Elem()))
-		case reflect.Slice:
-			replyv.Elem().Set(reflect.MakeSlice(m.reply.Elem(), 0, 0))
-		}
+		readcloser, _ = replyv.Elem().Interface().(io.ReadCloser)
 	}
-	err = func() (err error) {
-		defer func() {
-			if e := recover(); e != nil {
-				log.Error.Printf("panic in method call %s.%s\n%s", service, method, string(debug.Stack()))
-				err = fmt.Errorf("panic: %v", e)
-			}
-		}()
-		rvs := m.method.Func.Call([]reflect.Value{svc.recv, reflect.ValueOf(ctx), argv, replyv})
-		if e := rvs[0].Interface(); e != nil {
-			err = e.(error)
-		}
-		return
-	}()
 	code := 200
 	replyIface := replyv.Interface()
 	if err != nil {
@@ -278,8 +411,18 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// We pre-declare a trailer so that we can indicate if we encountered an error
 		// while streaming.
 		w.Header().Set("Trailer", bigmachineErrorTrailer)
+		var (
+			wr         io.Writer = w
+			wireWriter *sizeTrackingWriter
+			cw         *compressWriter
+		)
+		if replyEncoding != "" {
+			w.Header().Set("Content-Encoding", replyEncoding)
+			wireWriter = &sizeTrackingWriter{Writer: w}
+			cw = &compressWriter{newCompressor(replyEncoding, wireWriter), w}
+			wr = cw
+		}
 		w.WriteHeader(code)
-		var wr io.Writer = w
 		if _, needFlush := readcloser.(*flushOpt); needFlush {
 			if wf, ok := wr.(writeFlusher); ok {
 				wr = &flusher{wf}
@@ -287,29 +430,47 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				log.Printf("%s.%s: asked to flush, but HTTP connection does not support flushing", service, method)
 			}
 		}
-		var errStr string
-		if _, err = io.Copy(wr, readcloser); err != nil {
+		var (
+			errStr string
+			n      int64
+		)
+		n, err = io.Copy(wr, readcloser)
+		if err == nil && cw != nil {
+			err = cw.Close()
+		}
+		if err != nil {
 			log.Error.Printf("rpc: error writing reply: %v", err)
 			errStr = err.Error()
 		}
+		replyBytes = int(n)
+		if wireWriter != nil {
+			wireReplyBytes = wireWriter.Len()
+		}
 		// This is required because of a bug in net/http2 that causes the
 		// connection to hang when pre-declared trailers are not set.
 		w.Header().Set(bigmachineErrorTrailer, errStr)
 		return
 	}
-	w.Header().Set("Content-Type", gobContentType)
-	if code != 200 {
-		// Only write error codes here so that, if the call is a success
-		// but encoding fails, we have a chance to propagate the error
-		// properly.
-		w.WriteHeader(code)
-	}
 	b := new(bytes.Buffer)
-	enc := gob.NewEncoder(b)
-	err = enc.Encode(replyIface)
+	replyCodec, err = encodeReply(b, replyCodec, replyIface, code != 200)
 	replyBytes = b.Len()
+	p := b.Bytes()
+	// Errors are never compressed.
+	if err == nil && code == 200 && replyEncoding != "" {
+		if p, err = compress(replyEncoding, p); err == nil {
+			w.Header().Set("Content-Encoding", replyEncoding)
+			wireReplyBytes = len(p)
+		}
+	}
 	if err == nil {
-		_, err = w.Write(b.Bytes())
+		w.Header().Set("Content-Type", replyCodec.ContentType())
+		// Only write error codes here so that, if the call is a success
+		// but encoding fails, we have a chance to propagate the error
+		// properly.
+		if code != 200 {
+			w.WriteHeader(code)
+		}
+		_, err = w.Write(p)
 	}
 	if err != nil {
 		log.Error.Printf("rpc: error writing reply: %v", err)
@@ -319,6 +480,110 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// lookup returns the named service and method. It returns a nil
+// service if there is no such service, and a nil method if the
+// service has no such method.
+func (s *Server) lookup(serviceName, methodName string) (*service, *method) {
+	s.mu.RLock()
+	svc := s.services[serviceName]
+	s.mu.RUnlock()
+	if svc == nil {
+		return nil, nil
+	}
+	return svc, svc.methods[methodName]
+}
+
+// Drain stops the server from accepting new calls to any service
+// except those named by except: such calls fail with an error of
+// kind errors.Unavailable. Drain then waits for pending calls to the
+// other services to complete, returning nil once they have, or the
+// context's error if it is done first. Calls to the exempted
+// services continue to be served.
+func (s *Server) Drain(ctx context.Context, except ...string) error {
+	s.callMu.Lock()
+	if !s.draining {
+		s.draining = true
+		s.exempt = make(map[string]bool)
+		for _, name := range except {
+			s.exempt[name] = true
+		}
+		s.drained = make(chan struct{})
+		s.maybeDrained()
+	}
+	drained := s.drained
+	s.callMu.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enter registers a new call to the named service. It returns
+// false if the call should be refused because the server is
+// draining.
+func (s *Server) enter(service string) bool {
+	s.callMu.Lock()
+	defer s.callMu.Unlock()
+	if s.draining && !s.exempt[service] {
+		return false
+	}
+	s.pending[service]++
+	return true
+}
+
+// exit registers the completion of a call to the named service.
+func (s *Server) exit(service string) {
+	s.callMu.Lock()
+	defer s.callMu.Unlock()
+	s.pending[service]--
+	if s.draining {
+		s.maybeDrained()
+	}
+}
+
+// maybeDrained closes s.drained if there are no more pending calls
+// to non-exempt services. It must be called with s.callMu held.
+func (s *Server) maybeDrained() {
+	for service, n := range s.pending {
+		if n > 0 && !s.exempt[service] {
+			return
+		}
+	}
+	select {
+	case <-s.drained:
+	default:
+		close(s.drained)
+	}
+}
+
+// WriteError replies to a request with the provided error, encoded
+// in the same way as errors returned by methods: the client's Call
+// returns it as an error of kind errors.Remote. It may be used by
+// handlers that wrap a Server in order to reject calls before they
+// are dispatched.
+func WriteError(w http.ResponseWriter, err error) {
+	writeError(w, GobCodec, err)
+}
+
+// writeError replies to a request with the provided error, encoded
+// by the provided codec.
+func writeError(w http.ResponseWriter, codec Codec, err error) {
+	b := new(bytes.Buffer)
+	codec, err = encodeReply(b, codec, errors.Recover(err), true)
+	if err != nil {
+		log.Error.Printf("rpc: error encoding error reply: %v", err)
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.WriteHeader(methodErrorCode)
+	if _, err := w.Write(b.Bytes()); err != nil {
+		log.Error.Printf("rpc: error writing error reply: %v", err)
+	}
+}
+
 // Flush wraps the provided ReadCloser to instruct the rpc server to
 // flush after every write. This is useful when the reply stream
 // should be interactive -- no guarantees are otherwise provided
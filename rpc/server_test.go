@@ -9,6 +9,8 @@ import (
 	"context"
 	"crypto"
 	"crypto/rand"
+	"expvar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -19,6 +21,7 @@ import (
 
 	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/errors"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 const testPrefix = "/"
@@ -40,6 +43,14 @@ func (s *TestService) ErrorError(ctx context.Context, err *errors.Error, reply *
 	return err
 }
 
+func (s *TestService) ProtoEcho(ctx context.Context, arg *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+	if arg.Value == "" {
+		return errors.E(errors.Invalid, "empty message")
+	}
+	reply.Value = arg.Value
+	return nil
+}
+
 func TestServer(t *testing.T) {
 	srv := NewServer()
 	srv.Register("Test", new(TestService))
@@ -89,7 +100,76 @@ func TestServer(t *testing.T) {
 	}
 }
 
-type TestStreamService struct{}
+func TestCodec(t *testing.T) {
+	url, client := newTestClient(t)
+	ctx := context.Background()
+
+	// Protocol buffers are encoded as such.
+	reply := new(wrapperspb.StringValue)
+	if err := client.Call(ctx, url, "Test.ProtoEcho", wrapperspb.String("hello proto"), reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply.Value, "hello proto"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Errors cannot be encoded as protocol buffers.
+	err := client.Call(ctx, url, "Test.ProtoEcho", wrapperspb.String(""), reply)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !errors.Is(errors.Remote, err) || !errors.Match(errors.E(errors.Invalid, "empty message"), errors.Recover(err).Err) {
+		t.Errorf("bad error %v", err)
+	}
+
+	client.SetCodec("Test", JSONCodec)
+	var echo string
+	if err := client.Call(ctx, url, "Test.Echo", "hello json", &echo); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := echo, "hello json"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	e := errors.E(errors.Precondition, "xyz", errors.E(errors.NotExist, "abc"))
+	err = client.Call(ctx, url, "Test.ErrorError", e, nil)
+	if !errors.Is(errors.Remote, err) || !errors.Match(e, errors.Recover(err).Err) {
+		t.Errorf("error %v does not match expected error %v", err, e)
+	}
+	if err := client.Call(ctx, url, "Test.ProtoEcho", wrapperspb.String("hello protojson"), reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply.Value, "hello protojson"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Servers may be called without a bigmachine client.
+	resp, err := http.Post(url+"/Test.Echo", "application/json", strings.NewReader(`"hello curl"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := strings.TrimSpace(string(body)), `"hello curl"`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	resp, err = http.Post(url+"/Test.Echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusUnsupportedMediaType; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+type TestStreamService struct {
+	canceled chan struct{}
+}
 
 func (s *TestStreamService) Echo(ctx context.Context, arg io.Reader, reply *io.ReadCloser) error {
 	r, w := io.Pipe()
@@ -139,9 +219,35 @@ func (s *TestStreamService) Digest(ctx context.Context, arg io.Reader, reply *di
 	return nil
 }
 
+type testRecord struct {
+	Index int
+	Name  string
+}
+
+func (s *TestStreamService) Records(ctx context.Context, count int, reply chan<- testRecord) error {
+	for i := 0; i < count; i++ {
+		// Leave every other name empty, so that we test that values are
+		// reset between records.
+		var name string
+		if i%2 == 0 {
+			name = fmt.Sprint("record ", i)
+		}
+		select {
+		case reply <- testRecord{i, name}:
+		case <-ctx.Done():
+			close(s.canceled)
+			return ctx.Err()
+		}
+	}
+	if count == 3 {
+		return errors.E(errors.NotExist, "no more records")
+	}
+	return nil
+}
+
 func TestStream(t *testing.T) {
 	srv := NewServer()
-	srv.Register("Stream", new(TestStreamService))
+	srv.Register("Stream", &TestStreamService{canceled: make(chan struct{})})
 	httpsrv := httptest.NewServer(srv)
 	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
 	if err != nil {
@@ -199,3 +305,259 @@ func TestStream(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestStreamValues(t *testing.T) {
+	svc := &TestStreamService{canceled: make(chan struct{})}
+	srv := NewServer()
+	srv.Register("Stream", svc)
+	httpsrv := httptest.NewServer(srv)
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	const N = 10000
+	it, err := client.CallStream(ctx, httpsrv.URL, "Stream.Records", N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		record testRecord
+		n      int
+	)
+	for ; it.Next(&record); n++ {
+		want := testRecord{Index: n}
+		if n%2 == 0 {
+			want.Name = fmt.Sprint("record ", n)
+		}
+		if record != want {
+			t.Fatalf("got %v, want %v", record, want)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, N; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Errors are propagated with their kinds.
+	it, err = client.CallStream(ctx, httpsrv.URL, "Stream.Records", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n = 0; it.Next(&record); n++ {
+	}
+	if got, want := n, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	err = it.Err()
+	if !errors.Is(errors.Remote, err) || !errors.Is(errors.NotExist, errors.Recover(err).Err) {
+		t.Errorf("bad error %v", err)
+	}
+
+	// Closing the iterator cancels the method.
+	it, err = client.CallStream(ctx, httpsrv.URL, "Stream.Records", 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next(&record) {
+		t.Fatal(it.Err())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-svc.canceled
+
+	// Byte streams are not value streams.
+	_, err = client.CallStream(ctx, httpsrv.URL, "Stream.Gimme", 1)
+	if err == nil || !errors.Match(errors.E(errors.Fatal, errors.Invalid), err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	srv := NewServer()
+	srv.Register("Compressed", new(TestService))
+	srv.Register("Stream", &TestStreamService{canceled: make(chan struct{})})
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetCompression("Compressed", Gzip)
+	ctx := context.Background()
+
+	msg := strings.Repeat("all work and no play makes jack a dull boy. ", 1000)
+	var reply string
+	if err := client.Call(ctx, httpsrv.URL, "Compressed.Echo", msg, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != msg {
+		t.Error("bad reply")
+	}
+	for _, stats := range []*rpcstats{&clientstats, &serverstats} {
+		method := stats.Path("method", "Compressed.Echo")
+		for _, payload := range []string{"request", "reply"} {
+			var n, compressed int64
+			if v, ok := method.Get(payload + "bytes").(*expvar.Int); ok {
+				n = v.Value()
+			}
+			if v, ok := method.Get("compressed" + payload + "bytes").(*expvar.Int); ok {
+				compressed = v.Value()
+			}
+			if compressed <= 0 || compressed >= n/10 {
+				t.Errorf("%s: %d bytes compressed to %d", payload, n, compressed)
+			}
+		}
+	}
+	// Errors are propagated as before.
+	err = client.Call(ctx, httpsrv.URL, "Compressed.Error", "the error message", nil)
+	if !errors.Is(errors.Remote, err) || errors.Recover(err).Err.Error() != "the error message" {
+		t.Errorf("bad error %v", err)
+	}
+
+	// Byte and value streams are compressed per call.
+	dctx := WithCompression(ctx, Deflate)
+	b := []byte(msg)
+	var rc io.ReadCloser
+	if err := client.Call(dctx, httpsrv.URL, "Stream.Echo", bytes.NewReader(b), &rc); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(b, c) {
+		t.Error("bad reply")
+	}
+	it, err := client.CallStream(dctx, httpsrv.URL, "Stream.Records", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		record testRecord
+		n      int
+	)
+	for ; it.Next(&record); n++ {
+		if record.Index != n {
+			t.Fatalf("got %v, want %v", record.Index, n)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 1000; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, method := range []string{"Stream.Echo", "Stream.Records"} {
+		if v, ok := serverstats.Path("method", method).Get("compressedreplybytes").(*expvar.Int); !ok || v.Value() <= 0 {
+			t.Errorf("%s: reply was not compressed", method)
+		}
+		// Clients record the sizes of streamed replies once they
+		// have been read.
+		var n, compressed int64
+		if v, ok := clientstats.Path("method", method).Get("replybytes").(*expvar.Int); ok {
+			n = v.Value()
+		}
+		if v, ok := clientstats.Path("method", method).Get("compressedreplybytes").(*expvar.Int); ok {
+			compressed = v.Value()
+		}
+		if compressed <= 0 || compressed >= n {
+			t.Errorf("%s: %d reply bytes compressed to %d", method, n, compressed)
+		}
+	}
+
+	err = client.Call(WithCompression(ctx, "lz4"), httpsrv.URL, "Compressed.Echo", msg, &reply)
+	if err == nil || !errors.Match(errors.E(errors.Fatal, errors.Invalid), err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, c := range []struct {
+		accept, want string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", Gzip},
+		{"br, deflate;q=0.5, gzip", Deflate},
+		{"GZIP", Gzip},
+		{"gzip;q=0, deflate", Deflate},
+		{"gzip; q=0.000", ""},
+		{"gzip;q=0.1", Gzip},
+	} {
+		if got, want := negotiateEncoding(c.accept), c.want; got != want {
+			t.Errorf("%q: got %v, want %v", c.accept, got, want)
+		}
+	}
+}
+
+type TestDrainService struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *TestDrainService) Wait(ctx context.Context, _ struct{}, _ *struct{}) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *TestDrainService) Noop(ctx context.Context, _ struct{}, _ *struct{}) error {
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	svc := &TestDrainService{make(chan struct{}), make(chan struct{})}
+	srv := NewServer()
+	srv.Register("Drain", svc)
+	srv.Register("Test", new(TestService))
+	httpsrv := httptest.NewServer(srv)
+	client, err := NewClient(func() *http.Client { return httpsrv.Client() }, testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	callc := make(chan error)
+	go func() {
+		callc <- client.Call(ctx, httpsrv.URL, "Drain.Wait", struct{}{}, nil)
+	}()
+	<-svc.entered
+	drainc := make(chan error)
+	go func() {
+		drainc <- srv.Drain(ctx, "Test")
+	}()
+	// Wait for the drain to take effect.
+	for {
+		err := client.Call(ctx, httpsrv.URL, "Drain.Noop", struct{}{}, nil)
+		if err != nil {
+			if !errors.Is(errors.Remote, err) || !errors.Is(errors.Unavailable, errors.Recover(err).Err) {
+				t.Fatalf("bad error %v", err)
+			}
+			break
+		}
+	}
+	var reply string
+	if err := client.Call(ctx, httpsrv.URL, "Test.Echo", "exempt", &reply); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-drainc:
+		t.Fatalf("drain returned early: %v", err)
+	default:
+	}
+	close(svc.release)
+	if err := <-callc; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-drainc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,684 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/backgroundcontext"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// sessionEndpoint is the endpoint at which servers accept sessions.
+// Since it contains no ".", it cannot name a method; servers that do
+// not support sessions reject it as a bad request.
+const sessionEndpoint = "_session"
+
+// A sessionRequest heads each message sent by a client over a
+// session. Unless the request is a cancellation, it is followed by
+// the call's argument.
+type sessionRequest struct {
+	// ID identifies the call within the session. Calls are numbered
+	// from 1: the session's first message has ID 0; it is sent only
+	// to transmit the header's type, and is otherwise ignored.
+	ID uint64
+	// Method is the method to call ("Service.Method").
+	Method string
+	// Cancel indicates that the call with the given ID should be
+	// canceled.
+	Cancel bool
+}
+
+// A sessionReply heads each message sent by a server over a
+// session. Unless the reply carries an error or a fault, it is
+// followed by the call's reply.
+type sessionReply struct {
+	// ID identifies the call, as in sessionRequest.
+	ID uint64
+	// Err is the error returned by the method.
+	Err *errors.Error
+	// Fault describes why the call could not be performed; for
+	// example because the method does not exist, or because its
+	// argument could not be decoded.
+	Fault string
+}
+
+// A sessionEncoder encodes the messages sent by one side of a
+// session. Each message is a header optionally followed by a value;
+// all of them are encoded by a single, long-lived gob encoder so
+// that type descriptors are sent only once for each session.
+//
+// Messages are encoded into a buffer while holding the encoder's
+// lock, and are then written outside of it, in the order in which
+// they were encoded. Thus a message that is slow to write (e.g.,
+// because it is large, and its peer is not reading) delays the
+// writes of subsequent messages, but not their encoding, and the
+// callers of Encode may abandon their writes when their contexts
+// are done.
+type sessionEncoder struct {
+	mu    sync.Mutex
+	w     io.Writer
+	flush func()
+	buf   bytes.Buffer
+	enc   *gob.Encoder
+	// last is closed once the last encoded message has been
+	// written.
+	last chan struct{}
+
+	errMu sync.Mutex
+	// err is the first error encountered writing messages; after it
+	// no more messages are written.
+	err error
+}
+
+// newSessionEncoder returns a session encoder that writes messages
+// to w, calling flush (if not nil) after each. It writes the
+// session's first message, carrying the provided (zero) header.
+func newSessionEncoder(w io.Writer, flush func(), header interface{}) (*sessionEncoder, error) {
+	e := &sessionEncoder{w: w, flush: flush}
+	e.enc = gob.NewEncoder(&e.buf)
+	_, _, err := e.Encode(context.Background(), header, nil)
+	return e, err
+}
+
+// Encode writes a message with the provided header and value. The
+// value is omitted if it is nil. Encode returns the number of bytes
+// written, and the error encountered in writing them; after a write
+// error the session cannot be used. If the value cannot be encoded,
+// the message is not sent, and the encoding error is returned in
+// valueErr; the session remains usable.
+//
+// If the provided context is done before the message is written,
+// Encode returns the context's error; the message is still written,
+// as the session's subsequent messages depend on it.
+func (e *sessionEncoder) Encode(ctx context.Context, header, value interface{}) (n int, valueErr, err error) {
+	e.mu.Lock()
+	msg, valueErr, err := e.encode(header, value)
+	if err != nil || len(msg) == 0 {
+		e.mu.Unlock()
+		return 0, valueErr, err
+	}
+	prev, done := e.last, make(chan struct{})
+	e.last = done
+	e.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		e.errMu.Lock()
+		defer e.errMu.Unlock()
+		if e.err != nil {
+			return
+		}
+		_, e.err = e.w.Write(msg)
+		if e.flush != nil {
+			e.flush()
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return 0, valueErr, ctx.Err()
+	}
+	e.errMu.Lock()
+	err = e.err
+	e.errMu.Unlock()
+	if err != nil {
+		return 0, valueErr, err
+	}
+	return len(msg), valueErr, nil
+}
+
+// encode encodes a message with the provided header and value,
+// returning a copy of its encoding, which is empty if there is
+// nothing to write. It must be called with e.mu held.
+func (e *sessionEncoder) encode(header, value interface{}) (msg []byte, valueErr, err error) {
+	e.buf.Reset()
+	if err := e.enc.Encode(header); err != nil {
+		return nil, nil, err
+	}
+	if value != nil {
+		end := e.buf.Len()
+		if valueErr = e.enc.Encode(value); valueErr != nil {
+			// Since the header's type was sent with the session's first
+			// message, the header occupies exactly the first end bytes:
+			// we drop it so that the peer does not expect a value. What
+			// follows are complete type descriptors for the value, which
+			// must be kept: the encoder does not send them again.
+			descriptors := append([]byte(nil), e.buf.Bytes()[end:]...)
+			e.buf.Reset()
+			e.buf.Write(descriptors)
+		}
+	}
+	return append([]byte(nil), e.buf.Bytes()...), valueErr, nil
+}
+
+// A sessionDecoder decodes the messages received by one side of a
+// session.
+type sessionDecoder struct {
+	r   io.Reader
+	n   int
+	err error
+	br  *bufio.Reader
+	dec *gob.Decoder
+}
+
+func newSessionDecoder(r io.Reader) *sessionDecoder {
+	d := &sessionDecoder{r: r}
+	d.br = bufio.NewReader(d)
+	d.dec = gob.NewDecoder(d.br)
+	return d
+}
+
+// Read implements io.Reader for the decoder's buffer, keeping track
+// of the bytes read and of the first error encountered.
+func (d *sessionDecoder) Read(p []byte) (n int, err error) {
+	n, err = d.r.Read(p)
+	d.n += n
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return
+}
+
+// Decode decodes the next header or value into v, discarding it if
+// v is nil. It returns the number of bytes consumed. Decoding errors
+// do not affect subsequent messages unless Err returns an error.
+func (d *sessionDecoder) Decode(v interface{}) (n int, err error) {
+	start := d.n - d.br.Buffered()
+	err = d.dec.Decode(v)
+	return d.n - d.br.Buffered() - start, err
+}
+
+// Err returns the error with which the underlying stream failed, if
+// any. No messages can be decoded once the stream has failed.
+func (d *sessionDecoder) Err() error {
+	return d.err
+}
+
+// canSession tells whether a call with the provided argument and
+// reply, encoded by the provided codecs, can be made over a session.
+// Sessions carry gob-encoded values only.
+func canSession(arg, reply interface{}, argCodec, replyCodec Codec) bool {
+	if _, ok := arg.(io.Reader); ok {
+		return false
+	}
+	switch reply.(type) {
+	case *io.ReadCloser, **StreamIterator, **Stream:
+		return false
+	}
+	return argCodec == GobCodec && replyCodec == GobCodec
+}
+
+// A clientSession is a session between a client and a single server
+// over which the client's calls to that server are multiplexed.
+type clientSession struct {
+	client *Client
+	addr   string
+	// ready is closed once the session is established, or has failed
+	// to be.
+	ready chan struct{}
+
+	// enc, body, and resp are set once the session is established.
+	enc  *sessionEncoder
+	body *io.PipeWriter
+	resp *http.Response
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*sessionCall
+	// err is set when the session fails.
+	err error
+}
+
+// A sessionCall is a pending call made over a session.
+type sessionCall struct {
+	serviceMethod string
+	reply         interface{}
+	// replyBytes and err are set before done is closed.
+	replyBytes int
+	err        error
+	done       chan struct{}
+}
+
+// EnableSessions enables the client's session mode. In session mode,
+// the client maintains a single long-lived session with each server
+// over which it multiplexes its calls to that server. Calls that
+// pass their arguments and replies through a session share a
+// single gob encoder and decoder in each direction, so that type
+// descriptors are not resent with every call. Sessions are carried
+// by full-duplex HTTP/2 streams; calls to servers that do not
+// support them, and calls with streamed arguments or replies or
+// other codecs, are made individually as before.
+//
+// Calls made over a session are isolated from each other: each
+// call can be canceled individually, and failure to encode or
+// decode one call's values does not affect the session's other
+// calls.
+func (c *Client) EnableSessions() {
+	c.mu.Lock()
+	c.sessionsEnabled = true
+	c.mu.Unlock()
+}
+
+// session returns an established session to the server at the
+// provided address, or nil if the client is not in session mode, or
+// if a session cannot be established.
+func (c *Client) session(ctx context.Context, addr string) *clientSession {
+	c.mu.Lock()
+	if !c.sessionsEnabled || c.noSessions[addr] {
+		c.mu.Unlock()
+		return nil
+	}
+	s := c.sessions[addr]
+	if s == nil {
+		s = &clientSession{
+			client:  c,
+			addr:    addr,
+			ready:   make(chan struct{}),
+			pending: make(map[uint64]*sessionCall),
+		}
+		if c.sessions == nil {
+			c.sessions = make(map[string]*clientSession)
+		}
+		c.sessions[addr] = s
+		go s.open()
+	}
+	c.mu.Unlock()
+	select {
+	case <-s.ready:
+	case <-ctx.Done():
+		return nil
+	}
+	if s.enc == nil {
+		return nil
+	}
+	return s
+}
+
+// removeSession removes the provided session from the client, so
+// that subsequent calls establish a new one.
+func (c *Client) removeSession(s *clientSession) {
+	c.mu.Lock()
+	if c.sessions[s.addr] == s {
+		delete(c.sessions, s.addr)
+	}
+	c.mu.Unlock()
+}
+
+// open establishes the session. Servers that reject sessions are
+// remembered, so that calls to them are made individually.
+func (s *clientSession) open() {
+	defer close(s.ready)
+	url := strings.TrimRight(s.addr, "/") + s.client.prefix + sessionEndpoint
+	r, w := io.Pipe()
+	req, err := http.NewRequest("POST", url, r)
+	if err != nil {
+		s.openFailed(w, err, false)
+		return
+	}
+	req.Header.Set("Content-Type", gobContentType)
+	resp, err := s.client.getClient(s.addr).Client().Do(req)
+	if err != nil {
+		s.openFailed(w, err, false)
+		return
+	}
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		unsupported := resp.StatusCode == http.StatusHTTPVersionNotSupported ||
+			400 <= resp.StatusCode && resp.StatusCode < 500
+		s.openFailed(w, fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(body))), unsupported)
+		return
+	}
+	enc, err := newSessionEncoder(w, nil, sessionRequest{})
+	if err != nil {
+		resp.Body.Close()
+		s.openFailed(w, err, false)
+		return
+	}
+	s.enc, s.body, s.resp = enc, w, resp
+	go s.read(newSessionDecoder(resp.Body))
+}
+
+// openFailed records that the session could not be established. If
+// unsupported is set, the server does not support sessions.
+func (s *clientSession) openFailed(w *io.PipeWriter, err error, unsupported bool) {
+	w.CloseWithError(err)
+	s.client.mu.Lock()
+	if unsupported {
+		if s.client.noSessions == nil {
+			s.client.noSessions = make(map[string]bool)
+		}
+		s.client.noSessions[s.addr] = true
+	}
+	s.client.mu.Unlock()
+	s.client.removeSession(s)
+	if unsupported {
+		log.Printf("rpc: %s does not support sessions: %v", s.addr, err)
+	} else {
+		log.Error.Printf("rpc: failed to establish session with %s: %v", s.addr, err)
+	}
+}
+
+// call makes a call over the session. It returns the number of bytes
+// sent for the call's request, and received for its reply.
+func (s *clientSession) call(ctx context.Context, serviceMethod string, arg, reply interface{}) (requestBytes, replyBytes int, err error) {
+	call := &sessionCall{
+		serviceMethod: serviceMethod,
+		reply:         reply,
+		replyBytes:    -1,
+		done:          make(chan struct{}),
+	}
+	s.mu.Lock()
+	if err := s.err; err != nil {
+		s.mu.Unlock()
+		return -1, -1, errors.E(errors.Net, errors.Temporary, err)
+	}
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = call
+	s.mu.Unlock()
+
+	requestBytes, valueErr, err := s.enc.Encode(ctx, sessionRequest{ID: id, Method: serviceMethod}, arg)
+	if ctxErr := ctx.Err(); valueErr == nil && err != nil && err == ctxErr {
+		// The request is written once the session's preceding
+		// messages are; it is canceled once it is.
+		s.cancel(id)
+		return -1, -1, err
+	}
+	if valueErr != nil || err != nil {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+		if err != nil {
+			s.fail(err)
+			return -1, -1, errors.E(errors.Net, errors.Temporary, err)
+		}
+		// As with individual calls, this is a failure to encode, which
+		// will not succeed on retry without intervention.
+		return -1, -1, errors.E(errors.Fatal, errors.Invalid, valueErr)
+	}
+	select {
+	case <-call.done:
+		return requestBytes, call.replyBytes, call.err
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	_, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	if !ok {
+		// The call completed concurrently; its reply may be in the
+		// process of being decoded.
+		<-call.done
+		return requestBytes, call.replyBytes, call.err
+	}
+	s.cancel(id)
+	return requestBytes, -1, ctx.Err()
+}
+
+// cancel abandons the pending call with the provided ID and sends
+// its cancellation to the server. The cancellation is written
+// asynchronously, so that the caller is not delayed by the session's
+// preceding messages.
+func (s *clientSession) cancel(id uint64) {
+	s.mu.Lock()
+	delete(s.pending, id)
+	s.mu.Unlock()
+	go func() {
+		if _, _, err := s.enc.Encode(context.Background(), sessionRequest{ID: id, Cancel: true}, nil); err != nil {
+			s.fail(err)
+		}
+	}()
+}
+
+// read reads replies from the session until it fails, completing
+// the corresponding calls. Replies to canceled calls are discarded.
+func (s *clientSession) read(dec *sessionDecoder) {
+	for {
+		var header sessionReply
+		if _, err := dec.Decode(&header); err != nil {
+			s.fail(err)
+			return
+		}
+		if header.ID == 0 {
+			continue
+		}
+		s.mu.Lock()
+		call := s.pending[header.ID]
+		delete(s.pending, header.ID)
+		s.mu.Unlock()
+		var err error
+		switch {
+		case header.Fault != "":
+			err = errors.E(errors.Fatal, errors.Invalid, header.Fault)
+		case header.Err != nil:
+			err = errors.E(errors.Remote, header.Err)
+		default:
+			var reply interface{}
+			if call != nil {
+				reply = call.reply
+			}
+			n, decodeErr := dec.Decode(reply)
+			if decodeErr != nil && dec.Err() != nil {
+				if call != nil {
+					call.err = errors.E(errors.Net, errors.Temporary, decodeErr)
+					close(call.done)
+				}
+				s.fail(decodeErr)
+				return
+			}
+			if call == nil {
+				continue
+			}
+			call.replyBytes = n
+			if decodeErr != nil {
+				err = errors.E(errors.Invalid, errors.Temporary, "error while decoding reply for "+call.serviceMethod, decodeErr)
+			}
+		}
+		if call != nil {
+			call.err = err
+			close(call.done)
+		}
+	}
+}
+
+// fail fails the session with the provided error, which is returned
+// (as an error of kind errors.Net) to its pending calls. Subsequent
+// calls establish a new session.
+func (s *clientSession) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	s.client.removeSession(s)
+	s.body.CloseWithError(err)
+	s.resp.Body.Close()
+	if err != io.EOF {
+		log.Error.Printf("rpc: session with %s failed: %v", s.addr, err)
+	}
+	for _, call := range pending {
+		call.err = errors.E(errors.Net, errors.Temporary, "session failed", err)
+		close(call.done)
+	}
+}
+
+// A serverSession is the server's side of a session.
+type serverSession struct {
+	server *Server
+	enc    *sessionEncoder
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	calls map[uint64]context.CancelFunc
+}
+
+// serveSession serves a session: it dispatches the calls received
+// over the request body, writing their replies to the response as
+// they complete. Sessions require full-duplex streams, and thus
+// HTTP/2.
+func (s *Server) serveSession(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if r.ProtoMajor < 2 || !ok {
+		// The client does not close the request body until it receives
+		// the reply: the body must not be drained before then, either
+		// by us or by the HTTP server.
+		w.Header().Set("Connection", "close")
+		http.Error(w, "sessions require HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", gobContentType)
+	w.WriteHeader(200)
+	enc, err := newSessionEncoder(w, flusher.Flush, sessionReply{})
+	if err != nil {
+		log.Error.Printf("rpc: session %s: %v", r.RemoteAddr, err)
+		return
+	}
+	sess := &serverSession{
+		server: s,
+		enc:    enc,
+		calls:  make(map[uint64]context.CancelFunc),
+	}
+	ctx, cancel := context.WithCancel(backgroundcontext.Wrap(r.Context()))
+	defer cancel()
+	dec := newSessionDecoder(r.Body)
+	for {
+		var req sessionRequest
+		if _, err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				log.Error.Printf("rpc: session %s: %v", r.RemoteAddr, err)
+			}
+			break
+		}
+		if req.ID == 0 {
+			continue
+		}
+		if req.Cancel {
+			sess.cancel(req.ID)
+			continue
+		}
+		if err := sess.dispatch(ctx, dec, req); err != nil {
+			log.Error.Printf("rpc: session %s: %v", r.RemoteAddr, err)
+			break
+		}
+	}
+	// Replies may not be written once the handler returns.
+	sess.wg.Wait()
+}
+
+// dispatch reads the argument of the provided request and dispatches
+// the call. Calls that cannot be performed are replied to with a
+// fault. Dispatch returns an error only if the session's stream has
+// failed.
+func (ss *serverSession) dispatch(ctx context.Context, dec *sessionDecoder, req sessionRequest) error {
+	var (
+		svc   *service
+		m     *method
+		fault string
+	)
+	if parts := strings.SplitN(req.Method, ".", 2); len(parts) != 2 {
+		fault = "bad method " + req.Method
+	} else if svc, m = ss.server.lookup(parts[0], parts[1]); svc == nil {
+		fault = "no such service"
+	} else if m == nil {
+		fault = "no such method"
+	} else if m.arg == typeOfReader || m.stream || m.duplex || m.reply.Elem() == typeOfReadCloser {
+		fault = "streaming methods cannot be called over sessions"
+	}
+	if fault != "" {
+		// The argument must still be consumed.
+		if _, err := dec.Decode(nil); err != nil && dec.Err() != nil {
+			return err
+		}
+		ss.reply(sessionReply{ID: req.ID, Fault: req.Method + ": " + fault}, nil)
+		return nil
+	}
+	argv, ptr := m.newArg()
+	requestBytes, err := dec.Decode(ptr.Interface())
+	if err != nil {
+		if dec.Err() != nil {
+			return err
+		}
+		ss.reply(sessionReply{ID: req.ID, Fault: fmt.Sprintf("%s: error decoding request: %v", req.Method, err)}, nil)
+		return nil
+	}
+	if !ss.server.enter(svc.name) {
+		err := errors.E(errors.Unavailable, errors.Temporary, "server is draining")
+		ss.reply(sessionReply{ID: req.ID, Err: errors.Recover(err)}, nil)
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	ss.mu.Lock()
+	ss.calls[req.ID] = cancel
+	ss.mu.Unlock()
+	ss.wg.Add(1)
+	go func() {
+		defer ss.wg.Done()
+		defer ss.server.exit(svc.name)
+		defer ss.cancel(req.ID)
+		done := serverstats.Start("", req.Method)
+		replyv := m.newReply()
+		err := svc.call(ctx, m, argv, replyv)
+		header := sessionReply{ID: req.ID}
+		var value interface{}
+		if err != nil {
+			header.Err = errors.Recover(err)
+		} else {
+			value = replyv.Interface()
+		}
+		replyBytes, valueErr := ss.reply(header, value)
+		if valueErr != nil {
+			err = valueErr
+			replyBytes, _ = ss.reply(sessionReply{ID: req.ID, Fault: fmt.Sprintf("%s: error encoding reply: %v", req.Method, valueErr)}, nil)
+		}
+		done(int64(requestBytes), int64(replyBytes), err)
+	}()
+	return nil
+}
+
+// reply writes a reply to the session. It returns the number of
+// bytes written, and the error encountered encoding the value, if
+// any. Write errors are logged: they are also encountered by the
+// session's reader, which then ends the session.
+func (ss *serverSession) reply(header sessionReply, value interface{}) (int, error) {
+	n, valueErr, err := ss.enc.Encode(context.Background(), header, value)
+	if valueErr != nil {
+		log.Error.Printf("rpc: error encoding reply: %v", valueErr)
+	}
+	if err != nil {
+		log.Error.Printf("rpc: error writing reply: %v", err)
+	}
+	return n, valueErr
+}
+
+// cancel cancels the call with the provided ID, if it is pending.
+func (ss *serverSession) cancel(id uint64) {
+	ss.mu.Lock()
+	cancel := ss.calls[id]
+	delete(ss.calls, id)
+	ss.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
@@ -23,3 +23,21 @@ func (s *sizeTrackingReader) Read(p []byte) (n int, err error) {
 // Len returns the total number of bytes read from the
 // underlying reader.
 func (s *sizeTrackingReader) Len() int { return s.n }
+
+// SizeTrackingWriter keeps track of the number of bytes written
+// through the underlying writer.
+type sizeTrackingWriter struct {
+	io.Writer
+	n int
+}
+
+// Write implements io.Writer.
+func (s *sizeTrackingWriter) Write(p []byte) (n int, err error) {
+	n, err = s.Writer.Write(p)
+	s.n += n
+	return
+}
+
+// Len returns the total number of bytes written to the underlying
+// writer.
+func (s *sizeTrackingWriter) Len() int { return s.n }
@@ -6,6 +6,7 @@ package rpc
 
 import (
 	"expvar"
+	"sort"
 	"sync"
 	"time"
 )
@@ -54,6 +55,81 @@ func (t *treestats) Child(name string) *treestats {
 // and method.
 type rpcstats struct {
 	treestats
+
+	latencyMu sync.Mutex
+	latencies map[string]*latencySamples
+}
+
+const (
+	// numLatencySamples is the number of recent latencies retained
+	// for each method.
+	numLatencySamples = 256
+	// minLatencySamples is the number of latencies that must be
+	// observed for a method before its quantiles are estimated.
+	minLatencySamples = 16
+)
+
+// LatencySamples is a ring of recent call latencies.
+type latencySamples struct {
+	samples [numLatencySamples]time.Duration
+	n       int
+}
+
+func (l *latencySamples) add(d time.Duration) {
+	l.samples[l.n%numLatencySamples] = d
+	l.n++
+}
+
+func (l *latencySamples) quantile(q float64) (time.Duration, bool) {
+	n := l.n
+	if n < minLatencySamples {
+		return 0, false
+	}
+	if n > numLatencySamples {
+		n = numLatencySamples
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, l.samples[:n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(q * float64(n))
+	if i >= n {
+		i = n - 1
+	} else if i < 0 {
+		i = 0
+	}
+	return sorted[i], true
+}
+
+// Latency returns the q-quantile (0 <= q <= 1) of the latencies of
+// recent successful client calls to the provided method, across all
+// addresses. Latency returns false if too few calls have been observed
+// to estimate it.
+func Latency(method string, q float64) (time.Duration, bool) {
+	return clientstats.latency(method, q)
+}
+
+func (r *rpcstats) latency(method string, q float64) (time.Duration, bool) {
+	r.latencyMu.Lock()
+	defer r.latencyMu.Unlock()
+	l := r.latencies[method]
+	if l == nil {
+		return 0, false
+	}
+	return l.quantile(q)
+}
+
+func (r *rpcstats) observe(method string, d time.Duration) {
+	r.latencyMu.Lock()
+	defer r.latencyMu.Unlock()
+	if r.latencies == nil {
+		r.latencies = make(map[string]*latencySamples)
+	}
+	l := r.latencies[method]
+	if l == nil {
+		l = new(latencySamples)
+		r.latencies[method] = l
+	}
+	l.add(d)
 }
 
 // Start starts an RPC stat with the provided address and method. It returns a
@@ -68,7 +144,8 @@ func (r *rpcstats) Start(addr, method string) (done func(requestBytes, replyByte
 	}
 	now := time.Now()
 	return func(requestBytes, replyBytes int64, err error) {
-		elapsed := int64(time.Since(now).Nanoseconds()) / 1e6
+		latency := time.Since(now)
+		elapsed := int64(latency.Nanoseconds()) / 1e6
 		r.Path("method", method).Add("time", elapsed)
 		if requestBytes > 0 {
 			r.Path("method", method).Add("requestbytes", requestBytes)
@@ -80,6 +157,8 @@ func (r *rpcstats) Start(addr, method string) (done func(requestBytes, replyByte
 		}
 		if err != nil {
 			r.Path("method", method).Add("errors", 1)
+		} else {
+			r.observe(method, latency)
 		}
 		r.max(elapsed, "method", method, "maxtime")
 
@@ -90,6 +169,31 @@ func (r *rpcstats) Start(addr, method string) (done func(requestBytes, replyByte
 	}
 }
 
+// Compressed records the sizes of an RPC's compressed payloads, as
+// they were transmitted; the sizes passed to the function returned
+// by Start are those of the uncompressed payloads. Sizes are -1 for
+// payloads that were not compressed.
+func (r *rpcstats) compressed(method string, requestBytes, replyBytes int64) {
+	if requestBytes > 0 {
+		r.Path("method", method).Add("compressedrequestbytes", requestBytes)
+	}
+	if replyBytes > 0 {
+		r.Path("method", method).Add("compressedreplybytes", replyBytes)
+	}
+}
+
+// Streamed records the sizes of an RPC's streamed reply, as read and
+// as transmitted (see compressed), once the reply has been read; the
+// reply size passed to the function returned by Start is -1 for
+// streamed replies.
+func (r *rpcstats) streamed(method string, replyBytes, wireReplyBytes int64) {
+	if replyBytes > 0 {
+		r.Path("method", method).Add("replybytes", replyBytes)
+		r.max(replyBytes, "method", method, "maxreplybytes")
+	}
+	r.compressed(method, -1, wireReplyBytes)
+}
+
 func (r *rpcstats) max(val int64, path ...string) {
 	path, name := path[:len(path)-1], path[len(path)-1]
 	r.Path(path...).Add(name, 0)
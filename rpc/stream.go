@@ -0,0 +1,222 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"io"
+	"net/http"
+	"reflect"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+const (
+	// gobStreamContentType is the content type of replies that
+	// stream a sequence of gob-encoded values.
+	gobStreamContentType = "application/x-gob-stream"
+
+	// streamBufferSize is the capacity of the channels over which
+	// methods stream their replies.
+	streamBufferSize = 64
+)
+
+// serveStream serves a call to a method that streams its replies
+// over a channel. The values sent by the method are gob-encoded to
+// the response, by a single encoder, as they are received; the
+// response is flushed whenever no more values are immediately
+// available. Since the method's sends block while the response is
+// being written, the client's consumption of the stream regulates
+// the method's production. Once the method returns, its error, if
+// any, is set in the response trailer. If encoding is not empty, the
+// stream is compressed with it. ServeStream returns the number of
+// bytes encoded, and, if the stream is compressed, the number of
+// compressed bytes written.
+func serveStream(ctx context.Context, w http.ResponseWriter, svc *service, m *method, argv reflect.Value, encoding string) (replyBytes, wireBytes int, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	replyc := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, m.reply.Elem()), streamBufferSize)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- svc.call(ctx, m, argv, replyc)
+		replyc.Close()
+	}()
+	w.Header().Set("Content-Type", gobStreamContentType)
+	// We pre-declare a trailer so that we can indicate if we encountered an error
+	// while streaming.
+	w.Header().Set("Trailer", bigmachineErrorTrailer)
+	var (
+		wr         io.Writer = w
+		wireWriter *sizeTrackingWriter
+		cw         *compressWriter
+	)
+	flusher, _ := w.(http.Flusher)
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+		wireWriter = &sizeTrackingWriter{Writer: w}
+		cw = &compressWriter{newCompressor(encoding, wireWriter), w}
+		wr, flusher = cw, cw
+	}
+	w.WriteHeader(200)
+	sizeWriter := &sizeTrackingWriter{Writer: wr}
+	enc := gob.NewEncoder(sizeWriter)
+	var encodeErr error
+	for {
+		v, ok := replyc.TryRecv()
+		if !v.IsValid() {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			v, ok = replyc.Recv()
+		}
+		if !ok {
+			break
+		}
+		// Once the stream has failed, we continue to receive values
+		// until the method notices the cancellation and returns, so
+		// that it does not block indefinitely.
+		if encodeErr != nil {
+			continue
+		}
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			encodeErr = errors.E(errors.Invalid, "nil value sent to stream")
+		} else {
+			encodeErr = enc.EncodeValue(v)
+		}
+		if encodeErr != nil {
+			log.Error.Printf("rpc: error writing %s.%s stream: %v", svc.name, m.method.Name, encodeErr)
+			cancel()
+		}
+	}
+	if cw != nil && encodeErr == nil {
+		encodeErr = cw.Close()
+	}
+	err = <-errc
+	if encodeErr != nil {
+		err = encodeErr
+	}
+	// This is required because of a bug in net/http2 that causes the
+	// connection to hang when pre-declared trailers are not set.
+	w.Header().Set(bigmachineErrorTrailer, encodeStreamError(err))
+	wireBytes = -1
+	if wireWriter != nil {
+		wireBytes = wireWriter.Len()
+	}
+	return sizeWriter.Len(), wireBytes, err
+}
+
+// encodeStreamError encodes an error for transmission in the trailer
+// of a value stream. Unlike the trailers of byte streams, which carry
+// only error messages, errors are gob-encoded so that their kinds are
+// preserved.
+func encodeStreamError(err error) string {
+	if err == nil {
+		return ""
+	}
+	var b bytes.Buffer
+	if encodeErr := gob.NewEncoder(&b).Encode(errors.Recover(err)); encodeErr != nil {
+		log.Error.Printf("rpc: error encoding stream error: %v", encodeErr)
+		b.Reset()
+		_ = gob.NewEncoder(&b).Encode(&errors.Error{Message: err.Error()})
+	}
+	return base64.StdEncoding.EncodeToString(b.Bytes())
+}
+
+// decodeStreamError decodes an error encoded by encodeStreamError.
+// The error is wrapped with errors.Remote, as are errors returned by
+// unary methods.
+func decodeStreamError(serviceMethod, trailer string) error {
+	if trailer == "" {
+		return nil
+	}
+	p, err := base64.StdEncoding.DecodeString(trailer)
+	if err != nil {
+		return errors.E(errors.Invalid, "error while decoding stream error for "+serviceMethod, err)
+	}
+	e := new(errors.Error)
+	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(e); err != nil {
+		return errors.E(errors.Invalid, "error while decoding stream error for "+serviceMethod, err)
+	}
+	return errors.E(errors.Remote, e)
+}
+
+// A StreamIterator iterates over the values streamed by a method of
+// the form
+//
+//	Func(ctx context.Context, arg argType, reply chan<- replyType) error
+//
+// StreamIterators are returned by (*Client).CallStream, or by Call
+// when it is given a **StreamIterator reply. Values are decoded as
+// they are received, and are read from the server only as fast as
+// they are consumed. The client must either exhaust the iterator or
+// close it.
+type StreamIterator struct {
+	serviceMethod string
+	resp          *http.Response
+	dec           *gob.Decoder
+	done          bool
+	err           error
+}
+
+func newStreamIterator(serviceMethod string, resp *http.Response) *StreamIterator {
+	return &StreamIterator{
+		serviceMethod: serviceMethod,
+		resp:          resp,
+		dec:           gob.NewDecoder(resp.Body),
+	}
+}
+
+// Next decodes the next value in the stream into v, which must be a
+// pointer to a value of the method's reply type. Next returns false
+// when the stream is exhausted or has failed, after which Err
+// returns the stream's error, if any.
+func (it *StreamIterator) Next(v interface{}) bool {
+	if it.done {
+		return false
+	}
+	resetValue(v)
+	err := it.dec.Decode(v)
+	if err == nil {
+		return true
+	}
+	it.done = true
+	if err == io.EOF {
+		err = decodeStreamError(it.serviceMethod, it.resp.Trailer.Get(bigmachineErrorTrailer))
+	} else {
+		err = errors.E("error while reading stream for "+it.serviceMethod, err)
+	}
+	it.err = err
+	it.resp.Body.Close()
+	return false
+}
+
+// Err returns the error that ended the stream, if any. Errors
+// returned by the method are of kind errors.Remote, as they are for
+// Call.
+func (it *StreamIterator) Err() error {
+	return it.err
+}
+
+// Close closes the stream, canceling the method if it is still
+// producing values.
+func (it *StreamIterator) Close() error {
+	it.done = true
+	return it.resp.Body.Close()
+}
+
+// CallStream invokes a method that streams its replies over a
+// channel, returning an iterator over the streamed values. It is
+// equivalent to calling Call with a **StreamIterator reply.
+func (c *Client) CallStream(ctx context.Context, addr, serviceMethod string, arg interface{}) (*StreamIterator, error) {
+	var it *StreamIterator
+	if err := c.Call(ctx, addr, serviceMethod, arg, &it); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigmachine
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+)
+
+// SessionFile is an option that persists the B's session to the file
+// at the provided path, so that a driver that is restarted (e.g.,
+// after a crash) may reattach to the machines it previously started.
+//
+// The session file records the addresses, instance cookies, and
+// service names of the B's owned machines, as well as the state of
+// its systems (e.g., their authorities) that is needed to communicate
+// with them. It is rewritten whenever machines are started or
+// stopped.
+//
+// When a B is started with a session file that already exists, it
+// reattaches to the machines recorded in it: they are owned by the
+// new B, which resumes their keepalives. Reattached machines are
+// not re-registered with their services; these remain as they were
+// instantiated by the previous driver. Machines that cannot be
+// reattached, because they have since exited or because they are
+// now a different instance, fail as usual and are removed from the
+// session. Since machines exit when their keepalives expire, the
+// driver must be restarted within the keepalive window (about five
+// minutes) in order to reattach.
+func SessionFile(path string) Option {
+	return func(b *B) {
+		b.sessionPath = path
+	}
+}
+
+// A session is the persisted state of a B.
+type session struct {
+	// Systems contains the state of each SessionSystem, keyed
+	// by name.
+	Systems map[string][]byte
+	// Machines contains the B's owned machines.
+	Machines []sessionMachine
+}
+
+// A sessionMachine is the persisted state of a single owned machine.
+type sessionMachine struct {
+	Addr     string
+	Instance string
+	Maxprocs int
+	System   string
+	Services []string
+}
+
+// restoreSession restores the state of the B's systems from its
+// session file, if any, and records the file's machines so that they
+// may be reattached by reattach. RestoreSession is called after the
+// B's systems are initialized, but before their clients are created.
+func (b *B) restoreSession() error {
+	f, err := os.Open(b.sessionPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var sess session
+	if err := gob.NewDecoder(f).Decode(&sess); err != nil {
+		return errors.E(errors.Invalid, "decode session "+b.sessionPath, err)
+	}
+	for name, state := range sess.Systems {
+		system, ok := b.systems[name].(SessionSystem)
+		if !ok {
+			continue
+		}
+		if err := system.RestoreSession(state); err != nil {
+			return errors.E("restore session for system "+name, err)
+		}
+	}
+	b.restored = sess.Machines
+	return nil
+}
+
+// reattach reattaches to the machines recorded in the B's session
+// file (see restoreSession), if any, and records them in the B's
+// session.
+func (b *B) reattach() {
+	if len(b.restored) == 0 {
+		return
+	}
+	var machines []*Machine
+	b.mu.Lock()
+	for _, sm := range b.restored {
+		system := b.systems[sm.System]
+		if system == nil {
+			log.Error.Printf("session: machine %s: system %s is not registered", sm.Addr, sm.System)
+			continue
+		}
+		if b.machines[sm.Addr] != nil {
+			continue
+		}
+		m := &Machine{
+			Addr:     sm.Addr,
+			Maxprocs: sm.Maxprocs,
+			instance: sm.Instance,
+			owner:    true,
+			reattach: true,
+			system:   system,
+			services: make(map[string]interface{}),
+		}
+		for _, name := range sm.Services {
+			m.services[name] = nil
+		}
+		m.start(b)
+		b.machines[m.Addr] = m
+		machines = append(machines, m)
+	}
+	b.mu.Unlock()
+	if len(machines) > 0 {
+		log.Printf("session: reattaching to %d machines from %s", len(machines), b.sessionPath)
+	}
+	b.persist(machines)
+}
+
+// persist records the provided machines in the B's session file, and
+// arranges for the file to be updated when they stop. Persist is a
+// no-op if the B has no session file.
+func (b *B) persist(machines []*Machine) {
+	if b.sessionPath == "" {
+		return
+	}
+	for _, m := range machines {
+		m := m
+		go func() {
+			<-m.Wait(Stopped)
+			b.saveSession()
+		}()
+	}
+	b.saveSession()
+}
+
+// saveSession writes the B's current session to its session file.
+// The file is replaced atomically, so that a driver crash never
+// leaves a partially written session behind.
+func (b *B) saveSession() {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	sess := session{Systems: make(map[string][]byte)}
+	for _, system := range b.Systems() {
+		system, ok := system.(SessionSystem)
+		if !ok || b.clients[system.Name()] == nil {
+			continue
+		}
+		state, err := system.SessionState()
+		if err != nil {
+			log.Error.Printf("session: system %s: %v", system.Name(), err)
+			return
+		}
+		sess.Systems[system.Name()] = state
+	}
+	for _, m := range b.Machines() {
+		if !m.Owned() || m.instance == "" || m.State() == Stopped {
+			continue
+		}
+		sm := sessionMachine{
+			Addr:     m.Addr,
+			Instance: m.instance,
+			Maxprocs: m.Maxprocs,
+			System:   systemName(m),
+		}
+		for name := range m.services {
+			sm.Services = append(sm.Services, name)
+		}
+		sort.Strings(sm.Services)
+		sess.Machines = append(sess.Machines, sm)
+	}
+	sort.Slice(sess.Machines, func(i, j int) bool {
+		return sess.Machines[i].Addr < sess.Machines[j].Addr
+	})
+	if err := writeSession(b.sessionPath, sess); err != nil {
+		log.Error.Printf("session: %v", err)
+	}
+}
+
+func writeSession(path string, sess session) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(sess); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
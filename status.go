@@ -59,7 +59,9 @@ var statusTemplate = template.Must(template.New("status").
 		},
 	}).
 	Parse(`{{.machine.Addr}}
-{{if .machine.Owned}}	keepalive:
+{{with .system}}	system:	{{.}}
+{{end}}{{with .machine.Unhealthy}}	unhealthy:	{{.}}
+{{end}}{{if .machine.Owned}}	keepalive:
 		next:	{{.info.NextKeepalive}} (in {{until .info.NextKeepalive}})
 		reply times:	{{roundjoindur .info.KeepaliveReplyTimes}}
 {{end}}	memory:
@@ -119,6 +121,7 @@ func writeStatus(ctx context.Context, b *B, w io.Writer) error {
 		}
 		err := statusTemplate.Execute(&tw, map[string]interface{}{
 			"machine":   m,
+			"system":    systemName(m),
 			"info":      info,
 			"uptime":    time.Since(startTime),
 			"lastpause": info.MemInfo.Runtime.PauseNs[(info.MemInfo.Runtime.NumGC+255)%256],
@@ -130,6 +133,15 @@ func writeStatus(ctx context.Context, b *B, w io.Writer) error {
 	return nil
 }
 
+// systemName returns the name of the system on which machine m
+// runs, or the empty string if it is unknown.
+func systemName(m *Machine) string {
+	if m.system == nil {
+		return ""
+	}
+	return m.system.Name()
+}
+
 // StatusHandler implements an HTTP handler that displays machine
 // statuses.
 type statusHandler struct{ *B }
@@ -12,16 +12,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/bigmachine/rpc"
 	"github.com/shirou/gopsutil/disk"
@@ -30,8 +32,12 @@ import (
 )
 
 const (
-	maxTeeBuffer     = 1 << 20
-	memProfilePeriod = time.Minute
+	maxTeeBuffer = 1 << 20
+
+	// stopExitDelay is the amount of time the supervisor waits
+	// before exiting the process after replying to a Stop call,
+	// so that the reply can be delivered to the caller.
+	stopExitDelay = time.Second
 )
 
 var (
@@ -56,19 +62,49 @@ type Supervisor struct {
 	environ []string
 	server  *rpc.Server
 	nextc   chan time.Time
-	healthy uint32
+	// checkc is used to request an immediate health check.
+	checkc chan struct{}
+
+	// uploadMu serializes binary uploads.
+	uploadMu sync.Mutex
+
+	mu sync.Mutex
+	// instance is the instance cookie of the machine, if it has
+	// been assigned.
+	instance string
+	// thresholds are the resource thresholds used to determine
+	// the machine's health.
+	thresholds HealthThresholds
+	// checks are the registered services that implement health
+	// checks, keyed by service name.
+	checks map[string]healthChecker
+	// unhealthy describes why the machine is unhealthy; it is empty
+	// if the machine is healthy.
+	unhealthy string
+	// diskFull describes the machine's exhausted disk, if any.
+	diskFull *diskFull
+	// oomKills is the number of processes in the machine's cgroup
+	// that have been killed by the OOM killer.
+	oomKills int64
+	// memoryPressure describes the memory pressure on the machine's
+	// cgroup; it is empty if the pressure is below threshold.
+	memoryPressure string
 }
 
 // StartSupervisor starts a new supervisor based on the provided arguments.
 func StartSupervisor(ctx context.Context, b *B, system System, server *rpc.Server) *Supervisor {
 	s := &Supervisor{
-		b:      b,
-		system: system,
-		server: server,
+		b:        b,
+		system:   system,
+		server:   server,
+		instance: os.Getenv("BIGMACHINE_INSTANCE"),
 	}
-	s.healthy = 1
 	s.nextc = make(chan time.Time)
+	s.checkc = make(chan struct{}, 1)
 	go s.watchdog(ctx)
+	go s.healthcheck(ctx)
+	go s.watchDisks(ctx)
+	go s.watchMemory(ctx)
 	return s
 }
 
@@ -79,6 +115,10 @@ type Info struct {
 	Goos, Goarch string
 	// Digest is the fingerprint of the currently running binary on the machine.
 	Digest digest.Digest
+	// ChunkedUpload indicates that the machine supports chunked
+	// binary uploads through Supervisor.UploadChunk. It is unset by
+	// supervisors that predate them.
+	ChunkedUpload bool
 	// TODO: resources
 }
 
@@ -99,9 +139,10 @@ func LocalInfo() Info {
 		binaryDigest = dw.Digest()
 	})
 	return Info{
-		Goos:   runtime.GOOS,
-		Goarch: runtime.GOARCH,
-		Digest: binaryDigest,
+		Goos:          runtime.GOOS,
+		Goarch:        runtime.GOARCH,
+		Digest:        binaryDigest,
+		ChunkedUpload: true,
 	}
 }
 
@@ -114,11 +155,69 @@ type service struct {
 // this supervisor. After registration, the service is also initialized if it implements
 // the method
 //	Init(*B) error
+// Services that implement the method
+//	Health(context.Context) error
+// are included in the machine's health checks.
 func (s *Supervisor) Register(ctx context.Context, svc service, _ *struct{}) error {
 	if err := s.server.Register(svc.Name, svc.Instance); err != nil {
 		return err
 	}
-	return maybeInit(svc.Instance, s.b)
+	if err := maybeInit(svc.Instance, s.b); err != nil {
+		return err
+	}
+	if c, ok := svc.Instance.(healthChecker); ok {
+		s.mu.Lock()
+		if s.checks == nil {
+			s.checks = make(map[string]healthChecker)
+		}
+		s.checks[svc.Name] = c
+		s.mu.Unlock()
+		s.checkHealthNow()
+	}
+	return nil
+}
+
+// SetInstance assigns the machine's instance cookie. Once assigned,
+// the supervisor serves only calls that are addressed to the
+// instance (or that are not addressed to any instance). SetInstance
+// fails if the machine has already been assigned a different
+// instance.
+func (s *Supervisor) SetInstance(ctx context.Context, instance string, _ *struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.instance != "" && s.instance != instance {
+		return errors.E(errors.Precondition, instanceMismatch)
+	}
+	s.instance = instance
+	return nil
+}
+
+// Handler returns an HTTP handler that serves the supervisor's RPC
+// server. Calls are served under RpcPrefix, either directly or
+// prefixed by an instance cookie (see (*B).Start). Calls addressed to
+// an instance other than the machine's are rejected, and return
+// ErrInstanceMismatch to the caller.
+func (s *Supervisor) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, RpcPrefix) {
+			s.server.ServeHTTP(w, r)
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if len(parts) != 2 || !strings.HasPrefix("/"+parts[1], RpcPrefix) {
+			http.NotFound(w, r)
+			return
+		}
+		s.mu.Lock()
+		instance := s.instance
+		s.mu.Unlock()
+		if instance != "" && instance != parts[0] {
+			log.Error.Printf("rejecting call %s: instance %s does not match %s", r.URL.Path, parts[0], instance)
+			rpc.WriteError(w, errors.E(errors.Precondition, instanceMismatch))
+			return
+		}
+		s.server.ServeHTTP(w, r)
+	})
 }
 
 // Setargs sets the process' arguments. It should be used before Exec
@@ -139,27 +238,206 @@ func (s *Supervisor) Setenv(ctx context.Context, env []string, _ *struct{}) erro
 
 // Exec reads a new image from its argument and replaces the current
 // process with it. As a consequence, the currently running machine will
-// die. It is up to the caller to manage this interaction.
+// die. It is up to the caller to manage this interaction. If the
+// environment set by Setenv contains the image's digest (in
+// BIGMACHINE_IMAGE), the image is verified before it is exec'd. The
+// image is retained in the machine's binary cache, so that it may
+// later be exec'd again by ExecCached.
 func (s *Supervisor) Exec(ctx context.Context, exec io.Reader, _ *struct{}) error {
-	f, err := ioutil.TempFile("", "")
+	path, d, err := cacheBinary(exec)
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(f, exec); err != nil {
+	for _, kv := range s.environ {
+		if !strings.HasPrefix(kv, imageEnv+"=") {
+			continue
+		}
+		want, err := digester.Parse(strings.TrimPrefix(kv, imageEnv+"="))
+		if err != nil {
+			return errors.E(errors.Invalid, "parse image digest", err)
+		}
+		if d != want {
+			os.Remove(path)
+			return errors.E(errors.Integrity, fmt.Sprintf("binary: digest mismatch: got %v, want %v", d, want))
+		}
+	}
+	return s.exec(path)
+}
+
+// ExecCached replaces the current process with the image with the
+// provided digest from the machine's binary cache, as Exec does. It
+// returns an error of kind errors.NotExist if the image is not
+// cached. The cached image's digest is verified before it is exec'd;
+// a corrupted image is evicted.
+func (s *Supervisor) ExecCached(ctx context.Context, d digest.Digest, _ *struct{}) error {
+	path := cachedBinary(d)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return errors.E(errors.NotExist, fmt.Sprintf("binary %v is not cached", d))
+		}
+		return err
+	}
+	// Mark the binary as recently used, so that it is not evicted.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Error.Printf("binary cache: %v", err)
+	}
+	if err := verifyBinary(path, d); err != nil {
+		return err
+	}
+	return s.exec(path)
+}
+
+// UploadOffset replies with the number of bytes of the binary with
+// the provided digest that have been uploaded to the machine so far
+// by UploadChunk, so that interrupted uploads may be resumed.
+func (s *Supervisor) UploadOffset(ctx context.Context, d digest.Digest, offset *int64) error {
+	info, err := os.Stat(partialBinary(d))
+	switch {
+	case os.IsNotExist(err):
+		*offset = 0
+	case err != nil:
+		return err
+	default:
+		*offset = info.Size()
+	}
+	return nil
+}
+
+// UploadChunk appends a chunk of a binary to its partial upload, and
+// replies with the number of bytes uploaded so far. The chunk's
+// digest is verified, and its offset must match the size of the
+// partial upload.
+func (s *Supervisor) UploadChunk(ctx context.Context, chunk uploadChunk, offset *int64) error {
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+	var err error
+	*offset, err = writeChunk(chunk)
+	return err
+}
+
+// ExecUpload replaces the current process with the binary with the
+// provided digest, which has been uploaded by UploadChunk, as Exec
+// does. The binary's digest is verified before it is exec'd; a
+// corrupted binary is discarded.
+func (s *Supervisor) ExecUpload(ctx context.Context, d digest.Digest, _ *struct{}) error {
+	s.uploadMu.Lock()
+	path, err := commitUpload(d)
+	s.uploadMu.Unlock()
+	if err != nil {
 		return err
 	}
-	path := f.Name()
-	if err := f.Close(); err != nil {
+	return s.exec(path)
+}
+
+// An execFrom is a request to exec a binary retrieved from a peer
+// machine.
+type execFrom struct {
+	// Addr is the address of the peer machine.
+	Addr string
+	// Digest is the digest of the binary.
+	Digest digest.Digest
+}
+
+// ExecFrom retrieves the binary with the requested digest from the
+// requested peer machine, and then replaces the current process with
+// it, as Exec does. The binary's digest is verified before it is
+// exec'd.
+func (s *Supervisor) ExecFrom(ctx context.Context, req execFrom, _ *struct{}) error {
+	var rc io.ReadCloser
+	if err := s.b.client.Call(ctx, req.Addr, "Supervisor.Binary", req.Digest, &rc); err != nil {
+		return errors.E(fmt.Sprintf("retrieve binary from %s", req.Addr), err)
+	}
+	defer rc.Close()
+	path, d, err := cacheBinary(rc)
+	if err != nil {
 		return err
 	}
-	if err := os.Chmod(path, 0755); err != nil {
+	if d != req.Digest {
+		os.Remove(path)
+		return errors.E(errors.Integrity, fmt.Sprintf("binary from %s: digest mismatch: got %v, want %v", req.Addr, d, req.Digest))
+	}
+	return s.exec(path)
+}
+
+// Binary replies with the binary with the provided digest, so that
+// this machine may serve as a source of binaries for its peers. The
+// binary is served from the machine's binary cache, or else is the
+// binary of the current process. Binary returns an error of kind
+// errors.NotExist if no such binary is available.
+func (s *Supervisor) Binary(ctx context.Context, d digest.Digest, rc *io.ReadCloser) error {
+	f, err := os.Open(cachedBinary(d))
+	if err == nil {
+		*rc = f
+		return nil
+	}
+	if !os.IsNotExist(err) {
 		return err
 	}
+	if LocalInfo().Digest != d {
+		return errors.E(errors.NotExist, fmt.Sprintf("binary %v is not available", d))
+	}
+	*rc, err = binary()
+	return err
+}
+
+func (s *Supervisor) exec(path string) error {
 	log.Printf("exec %s %s", path, strings.Join(os.Args, " "))
 	environ := append(os.Environ(), s.environ...)
 	return syscall.Exec(path, os.Args, environ)
 }
 
+// stagePrefix is the file name prefix of files that are staged but
+// not yet committed.
+const stagePrefix = ".staged-"
+
+// StageFile writes the file provided in its argument to a temporary
+// location in the machine's file directory. It replies with a token
+// that identifies the staged file, along with the digest of its
+// contents, so that the caller may verify it before committing the
+// file with CommitFile.
+func (s *Supervisor) StageFile(ctx context.Context, r io.Reader, staged *stagedFile) error {
+	dir := s.b.FileDir()
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, stagePrefix)
+	if err != nil {
+		return err
+	}
+	dw := digester.NewWriter()
+	_, err = io.Copy(io.MultiWriter(f, dw), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	staged.Token = filepath.Base(f.Name())
+	staged.Digest = dw.Digest()
+	return nil
+}
+
+// CommitFile moves a file staged by StageFile to its final name in
+// the machine's file directory.
+func (s *Supervisor) CommitFile(ctx context.Context, commit commitFile, _ *struct{}) error {
+	if !strings.HasPrefix(commit.Token, stagePrefix) || filepath.Base(commit.Token) != commit.Token {
+		return errors.E(errors.Invalid, fmt.Sprintf("invalid staging token %q", commit.Token))
+	}
+	dir := s.b.FileDir()
+	staged := filepath.Join(dir, commit.Token)
+	if !validFileName(commit.Name) {
+		os.Remove(staged)
+		return errors.E(errors.Invalid, fmt.Sprintf("invalid file name %q", commit.Name))
+	}
+	path := filepath.Join(dir, commit.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return os.Rename(staged, path)
+}
+
 // Ping replies immediately with the sequence number provided.
 func (s *Supervisor) Ping(ctx context.Context, seq int, replyseq *int) error {
 	*replyseq = seq
@@ -281,6 +559,18 @@ type keepaliveReply struct {
 	// Healthy indicates whether the supervisor believes the process to
 	// be healthy. An unhealthy process may soon die.
 	Healthy bool
+	// Reason describes why the process is unhealthy.
+	Reason string
+	// DiskFull describes an exhausted disk, if any. Machines with
+	// exhausted disks are failed by the driver.
+	DiskFull *diskFull
+	// OOMKills is the number of processes in the machine's cgroup
+	// that have been killed by the OOM killer since the supervisor
+	// started.
+	OOMKills int64
+	// MemoryPressure describes excessive memory pressure on the
+	// machine's cgroup, if any.
+	MemoryPressure string
 }
 
 // Keepalive maintains the machine keepalive. The next argument
@@ -299,13 +589,36 @@ func (s *Supervisor) Keepalive(ctx context.Context, next time.Duration, reply *k
 	select {
 	case s.nextc <- t:
 		reply.Next = time.Until(t)
-		reply.Healthy = atomic.LoadUint32(&s.healthy) != 0
+		s.mu.Lock()
+		reply.Reason = s.unhealthy
+		reply.DiskFull = s.diskFull
+		reply.OOMKills = s.oomKills
+		reply.MemoryPressure = s.memoryPressure
+		s.mu.Unlock()
+		reply.Healthy = reply.Reason == ""
 		return nil
 	case <-ctx.Done():
 		return ctx.Err()
 	}
 }
 
+// Stop gracefully stops the machine. The machine's server stops
+// accepting calls to user services, and then waits for the pending
+// calls to complete, up to the provided timeout. Once they have
+// completed (or the timeout has expired), the process exits shortly
+// after Stop replies, thus releasing the machine's resources.
+func (s *Supervisor) Stop(ctx context.Context, timeout time.Duration, _ *struct{}) error {
+	drainCtx, cancel := context.WithTimeout(ctx, timeout)
+	err := s.server.Drain(drainCtx, "Supervisor")
+	cancel()
+	if err != nil {
+		log.Error.Printf("stop: failed to drain pending calls after %s: %v", timeout, err)
+	}
+	log.Printf("stop: exiting in %s", stopExitDelay)
+	time.AfterFunc(stopExitDelay, func() { s.system.Exit(0) })
+	return nil
+}
+
 // Getpid returns the PID of the supervisor process.
 func (s *Supervisor) Getpid(ctx context.Context, _ struct{}, pid *int) error {
 	*pid = os.Getpid()
@@ -348,8 +661,7 @@ func (s *Supervisor) watchdog(ctx context.Context) {
 	var (
 		tick = time.NewTicker(30 * time.Second)
 		// Give a generous initial timeout.
-		next           = time.Now().Add(2 * time.Minute)
-		lastMemProfile time.Time
+		next = time.Now().Add(2 * time.Minute)
 	)
 	for {
 		select {
@@ -362,21 +674,6 @@ func (s *Supervisor) watchdog(ctx context.Context) {
 			log.Error.Printf("Watchdog expiration: next=%s", next.Format(time.RFC3339))
 			s.system.Exit(1)
 		}
-		if time.Since(lastMemProfile) > memProfilePeriod {
-			vm, err := mem.VirtualMemory()
-			if err != nil {
-				// In the case of error, we don't change health status.
-				log.Error.Printf("failed to retrieve VM stats: %v", err)
-				continue
-			}
-			if used := vm.UsedPercent; used <= 95 {
-				atomic.StoreUint32(&s.healthy, 1)
-			} else {
-				log.Error.Printf("using %.1f%% of system memory; marking machine unhealthy", used)
-				atomic.StoreUint32(&s.healthy, 0)
-			}
-			lastMemProfile = time.Now()
-		}
 	}
 }
 
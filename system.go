@@ -43,7 +43,9 @@ type System interface {
 	// Start launches up to n new machines.  The returned machines can
 	// be in Unstarted state, but should eventually become available.
 	Start(ctx context.Context, n int) ([]*Machine, error)
-	// Exit is called to terminate a machine with the provided exit code.
+	// Exit is called to terminate a machine with the provided exit
+	// code. Exiting releases the machine (e.g., its instance), even
+	// when the exit code is 0.
 	Exit(int)
 	// Shutdown is called on graceful driver exit. It's should be used to
 	// perform system tear down. It is not guaranteed to be called.
@@ -62,6 +64,32 @@ type System interface {
 	Read(ctx context.Context, m *Machine, filename string) (io.Reader, error)
 }
 
+// A ResourceSystem is a System that can launch machines of varying
+// shapes, chosen according to resource requirements. (*B).Start uses
+// StartResources when machines are started with a Resources
+// parameter.
+type ResourceSystem interface {
+	System
+	// StartResources launches up to n new machines, each of which
+	// provides at least the resources described by r. It returns an
+	// error if no machine shape can satisfy the requirements.
+	StartResources(ctx context.Context, n int, r Resources) ([]*Machine, error)
+}
+
+// A SessionSystem is a System that maintains state, such as an
+// authority, that is needed to communicate with its machines from a
+// restarted driver. Its state is persisted in session files; see
+// SessionFile.
+type SessionSystem interface {
+	System
+	// SessionState returns the system's session state.
+	SessionState() ([]byte, error)
+	// RestoreSession restores state previously returned by
+	// SessionState. It is called after the system is initialized,
+	// but before any machines are started or dialed.
+	RestoreSession(state []byte) error
+}
+
 var (
 	systemsMu sync.Mutex
 	systems   = make(map[string]System)
@@ -131,6 +131,8 @@ func (s *System) Kill(m *bigmachine.Machine) bool {
 
 // Exited tells whether exit has been called on (any) machine.
 func (s *System) Exited() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.exited
 }
 
@@ -181,19 +183,35 @@ func (s *System) ListenAndServe(addr string, handler http.Handler) error {
 // behavior of a supervisor of a test machine and a regular machine
 // is that the test machine supervisor does not exec the process, as
 // this would break testing.
-func (s *System) Start(_ context.Context, count int) ([]*bigmachine.Machine, error) {
+func (s *System) Start(ctx context.Context, count int) ([]*bigmachine.Machine, error) {
+	return s.start(ctx, count, s.Machineprocs)
+}
+
+// StartResources starts count new machines, as Start does. Test
+// machines are assumed to satisfy any resource requirements; they
+// are given at least the requested number of processors.
+func (s *System) StartResources(ctx context.Context, count int, r bigmachine.Resources) ([]*bigmachine.Machine, error) {
+	procs := s.Machineprocs
+	if r.CPUs > procs {
+		procs = r.CPUs
+	}
+	return s.start(ctx, count, procs)
+}
+
+func (s *System) start(_ context.Context, count, procs int) ([]*bigmachine.Machine, error) {
 	s.mu.Lock()
 	machines := make([]*bigmachine.Machine, count)
 	for i := range machines {
 		ctx, cancel := context.WithCancel(context.Background())
 		server := rpc.NewServer()
-		server.Register("Supervisor", bigmachine.StartSupervisor(ctx, s.b, s, server))
+		supervisor := bigmachine.StartSupervisor(ctx, s.b, s, server)
+		server.Register("Supervisor", supervisor)
 		mux := http.NewServeMux()
-		mux.Handle(bigmachine.RpcPrefix, server)
+		mux.Handle("/", supervisor.Handler())
 		httpServer := httptest.NewServer(mux)
 		m := &bigmachine.Machine{
 			Addr:     httpServer.URL,
-			Maxprocs: s.Machineprocs,
+			Maxprocs: procs,
 			NoExec:   true,
 		}
 		s.machines = append(s.machines, &machine{m, cancel, httpServer})
@@ -206,7 +224,9 @@ func (s *System) Start(_ context.Context, count int) ([]*bigmachine.Machine, err
 
 // Exit marks the system as exited.
 func (s *System) Exit(int) {
+	s.mu.Lock()
 	s.exited = true
+	s.mu.Unlock()
 }
 
 // Maxprocs returns 1.
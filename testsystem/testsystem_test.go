@@ -5,16 +5,27 @@
 package testsystem
 
 import (
+	"bytes"
 	"context"
 	"encoding/gob"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/bigmachine"
+	"github.com/grailbio/testutil"
 )
 
 func init() {
 	gob.Register(&testService{})
+	gob.Register(&fileService{})
+	gob.Register(&healthService{})
 }
 
 type testService struct {
@@ -61,3 +72,696 @@ func TestTestSystem(t *testing.T) {
 	}
 	m.Wait(bigmachine.Stopped)
 }
+
+func TestStopAll(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 2, bigmachine.Services{
+		"Service": &testService{Index: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := b.StopAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range machines {
+		if got, want := m.State(), bigmachine.Stopped; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		var reply int
+		err := m.Call(ctx, "Service.Method", 0, &reply)
+		if err == nil || !errors.Is(errors.Unavailable, err) {
+			t.Errorf("bad error %v", err)
+		}
+	}
+	for !test.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInstanceMismatch(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{
+		"Service": &testService{Index: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	u, err := url.Parse(m.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path == "/" {
+		t.Fatalf("address %s has no instance cookie", m.Addr)
+	}
+	u.Path = "/0123456789abcdef/"
+	if _, err := b.Dial(ctx, u.String()); !errors.Match(bigmachine.ErrInstanceMismatch, err) {
+		t.Errorf("bad error %v", err)
+	}
+	u.Path = "/"
+	dialed, err := b.Dial(ctx, u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply int
+	if err := dialed.Call(ctx, "Service.Method", 0, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func (t *testService) Forward(ctx context.Context, m *bigmachine.Machine, reply *int) error {
+	return m.Call(ctx, "Service.Method", 0, reply)
+}
+
+func TestMachineHandle(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	m0, err := b.Start(ctx, 1, bigmachine.Services{
+		"Service": &testService{Index: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1, err := b.Start(ctx, 1, bigmachine.Services{
+		"Service": &testService{Index: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-m0[0].Wait(bigmachine.Running)
+	<-m1[0].Wait(bigmachine.Running)
+	var reply int
+	if err := m0[0].Call(ctx, "Service.Forward", m1[0], &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Decoded machines are non-owned handles to the machines tracked
+	// by b.
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(m1[0]); err != nil {
+			t.Fatal(err)
+		}
+		var m *bigmachine.Machine
+		if err := gob.NewDecoder(&buf).Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Owned() {
+			t.Error("decoded machine is owned")
+		}
+		if got, want := m.State(), bigmachine.Running; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if err := m.Call(ctx, "Service.Method", 0, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reply, 1; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// Stopping or canceling the handle does not affect the
+		// tracked machine.
+		if i == 0 {
+			if err := m.Stop(ctx); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			m.Cancel()
+		}
+		<-m.Wait(bigmachine.Stopped)
+		if got, want := m.Failure(), bigmachine.FailureCanceled; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if err := m.Call(ctx, "Service.Method", 0, &reply); err == nil {
+			t.Error("expected error")
+		}
+		if got, want := m1[0].State(), bigmachine.Running; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if got, want := len(b.Machines()), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := m0[0].Call(ctx, "Service.Forward", m1[0], &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	test := New()
+	test.KeepalivePeriod = time.Second
+	test.KeepaliveTimeout = 2 * time.Second
+	test.KeepaliveRpcTimeout = time.Second
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := b.Events(ctx)
+	machines, err := b.Start(ctx, 1, bigmachine.Services{
+		"Service": &testService{Index: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	if !test.Kill(m) {
+		t.Fatal("failed to kill machine")
+	}
+	for _, want := range []bigmachine.EventKind{
+		bigmachine.EventStarting,
+		bigmachine.EventRunning,
+		bigmachine.EventStopped,
+	} {
+		e := <-events
+		if got := e.Kind; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		if e.Machine != m {
+			t.Errorf("event %v for unexpected machine", e)
+		}
+		if want == bigmachine.EventStopped && e.Err == nil {
+			t.Error("expected stopped event to carry an error")
+		}
+	}
+	cancel()
+	for range events {
+	}
+}
+
+func TestResources(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1,
+		bigmachine.Services{"Service": &testService{}},
+		bigmachine.Resources{CPUs: 2},
+		bigmachine.Resources{CPUs: 4},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	if got, want := m.Maxprocs, 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// namedSystem is a test system with a different name, so that
+// several test systems may be registered with a single B.
+type namedSystem struct {
+	*System
+	name string
+}
+
+func (s namedSystem) Name() string { return s.name }
+
+func TestMultiSystem(t *testing.T) {
+	primary, other := New(), New()
+	b := bigmachine.Start(primary, bigmachine.Systems(namedSystem{other, "other"}))
+	defer b.Shutdown()
+	ctx := context.Background()
+	if got, want := len(b.Systems()), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, system := range []string{"testsystem", "other"} {
+		machines, err := b.Start(ctx, 1,
+			bigmachine.Services{"Service": &testService{Index: i}},
+			bigmachine.OnSystem(system),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := machines[0]
+		<-m.Wait(bigmachine.Running)
+		var reply int
+		if err := m.Call(ctx, "Service.Method", 0, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reply, i; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if got, want := primary.N(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := other.N(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(b.Machines()), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	_, err := b.Start(ctx, 1, bigmachine.Services{"Service": &testService{}}, bigmachine.OnSystem("unknown"))
+	if !errors.Is(errors.NotExist, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestSessionReattach(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(dir, "session")
+	newSystem := func() *System {
+		sys := New()
+		sys.KeepalivePeriod = time.Second
+		sys.KeepaliveTimeout = 2 * time.Second
+		sys.KeepaliveRpcTimeout = time.Second
+		return sys
+	}
+	ctx := context.Background()
+	sys1 := newSystem()
+	b1 := bigmachine.Start(sys1, bigmachine.SessionFile(path))
+	defer b1.Shutdown()
+	machines, err := b1.Start(ctx, 2, bigmachine.Services{
+		"Service": &testService{Index: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+	}
+
+	// A new driver with the same session file takes ownership of
+	// the machines.
+	b2 := bigmachine.Start(newSystem(), bigmachine.SessionFile(path))
+	defer b2.Shutdown()
+	reattached := b2.Machines()
+	if got, want := len(reattached), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, m := range reattached {
+		if !m.Owned() {
+			t.Errorf("machine %s not owned", m.Addr)
+		}
+		<-m.Wait(bigmachine.Running)
+		var reply int
+		if err := m.Call(ctx, "Service.Method", 0, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reply, 1; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Stopped machines are removed from the session.
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys1.Kill(machines[0])
+	for {
+		after, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before, after) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b3 := bigmachine.Start(newSystem(), bigmachine.SessionFile(path))
+	defer b3.Shutdown()
+	if got, want := len(b3.Machines()), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+type fileService struct {
+	Gobable struct{} // to make the struct gob-encodable
+	b       *bigmachine.B
+}
+
+func (s *fileService) Init(b *bigmachine.B) error {
+	s.b = b
+	return nil
+}
+
+func (s *fileService) Read(ctx context.Context, name string, reply *string) error {
+	p, err := ioutil.ReadFile(filepath.Join(s.b.FileDir(), name))
+	*reply = string(p)
+	return err
+}
+
+func TestFiles(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(dir, "index")
+	if err := ioutil.WriteFile(path, []byte("index contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1,
+		bigmachine.Services{"File": &fileService{}},
+		bigmachine.Files{
+			{Name: "index", Path: path},
+			{Name: "model/weights", Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader("model contents")), nil
+			}},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	for name, want := range map[string]string{
+		"index":         "index contents",
+		"model/weights": "model contents",
+	} {
+		var got string
+		if err := m.Call(ctx, "File.Read", name, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	machines, err = b.Start(ctx, 1,
+		bigmachine.Services{"File": &fileService{}},
+		bigmachine.Files{{Name: "../escape", Path: path}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = machines[0]
+	<-m.Wait(bigmachine.Stopped)
+	if err := m.Err(); err == nil || !strings.Contains(err.Error(), "invalid file name") {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+// Block blocks until the call is canceled if arg matches the
+// service's index; otherwise it behaves like Method.
+func (t *testService) Block(ctx context.Context, arg int, reply *int) error {
+	if arg == t.Index {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	*reply = t.Index
+	return nil
+}
+
+func TestBroadcast(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	var machines []*bigmachine.Machine
+	for i := 0; i < 3; i++ {
+		started, err := b.Start(ctx, 1, bigmachine.Services{
+			"Service": &testService{Index: i},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		machines = append(machines, started...)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+	}
+	newReply := func() interface{} { return new(int) }
+
+	results, err := b.Broadcast(ctx, machines, "Service.Method", 0, newReply, bigmachine.BroadcastConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Machine != machines[i] {
+			t.Errorf("result %d: wrong machine %s", i, r.Machine.Addr)
+		}
+		if got, want := *r.Reply.(*int), i; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	results, err = b.Broadcast(ctx, machines, "Service.Block", 2, newReply, bigmachine.BroadcastQuorum(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := results[2].Err; !errors.Is(errors.Canceled, err) {
+		t.Errorf("bad error %v", err)
+	}
+
+	results, err = b.Broadcast(ctx, machines, "Service.Block", 1, newReply, bigmachine.BroadcastTimeout(100*time.Millisecond))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for i, r := range results {
+		if (r.Err != nil) != (i == 1) {
+			t.Errorf("result %d: unexpected error %v", i, r.Err)
+		}
+	}
+
+	_, err = b.Broadcast(ctx, machines, "Service.Block", 1, newReply, bigmachine.BroadcastQuorum(3), bigmachine.BroadcastTimeout(100*time.Millisecond))
+	if !errors.Is(errors.Unavailable, err) {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestHedgedCall(t *testing.T) {
+	test := New()
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx := context.Background()
+	var machines []*bigmachine.Machine
+	for i := 0; i < 2; i++ {
+		started, err := b.Start(ctx, 1, bigmachine.Services{
+			"Service": &testService{Index: i},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		machines = append(machines, started...)
+	}
+	for _, m := range machines {
+		<-m.Wait(bigmachine.Running)
+	}
+	// The first machine answers promptly, so it wins.
+	var reply int
+	if err := b.HedgedCall(ctx, machines, "Service.Block", -1, &reply, bigmachine.HedgeDelay(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The first machine is a straggler, so the hedged call wins.
+	if err := b.HedgedCall(ctx, machines, "Service.Block", 0, &reply, bigmachine.HedgeDelay(10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Every call fails.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := b.HedgedCall(ctx, machines[:1], "Service.Block", 0, &reply); err == nil {
+		t.Error("expected error")
+	}
+}
+
+type healthService struct {
+	Unhealthy bool
+}
+
+func (s *healthService) Health(ctx context.Context) error {
+	if s.Unhealthy {
+		return errors.New("out of widgets")
+	}
+	return nil
+}
+
+func TestHealth(t *testing.T) {
+	test := New()
+	test.KeepalivePeriod = time.Second
+	test.KeepaliveTimeout = 2 * time.Second
+	test.KeepaliveRpcTimeout = time.Second
+	b := bigmachine.Start(test)
+	defer b.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := b.Events(ctx)
+
+	pool := b.Pool(ctx, 1,
+		bigmachine.Services{"Health": &healthService{Unhealthy: true}},
+		bigmachine.HealthThresholds{MemoryPercent: 100},
+		bigmachine.UnhealthyCordon,
+	)
+	defer pool.Close()
+	var e bigmachine.Event
+	for e = range events {
+		if e.Kind == bigmachine.EventUnhealthy {
+			break
+		}
+	}
+	m := e.Machine
+	if got, want := e.Reason, "service Health: out of widgets"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := m.Unhealthy(), e.Reason; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !m.Cordoned() {
+		t.Error("machine not cordoned")
+	}
+	// The event is not repeated while the machine stays unhealthy.
+	for timeout := time.After(3 * test.KeepalivePeriod); ; {
+		select {
+		case e := <-events:
+			if e.Kind == bigmachine.EventUnhealthy && e.Machine == m {
+				t.Errorf("repeated unhealthy event: %v", e)
+			}
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	if got, want := m.State(), bigmachine.Running; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if machines := pool.Machines(); len(machines) != 0 {
+		t.Errorf("cordoned machines returned by pool: %v", machines)
+	}
+
+	machines, err := b.Start(ctx, 1,
+		bigmachine.Services{"Health": &healthService{Unhealthy: true}},
+		bigmachine.UnhealthyStop,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = machines[0]
+	<-m.Wait(bigmachine.Stopped)
+	if err := m.Err(); !errors.Is(errors.Unavailable, err) || !strings.Contains(err.Error(), "out of widgets") {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	test := New()
+	test.KeepalivePeriod = 100 * time.Millisecond
+	test.KeepaliveTimeout = time.Second
+	test.KeepaliveRpcTimeout = time.Second
+	b := bigmachine.Start(test, bigmachine.Diagnostics(bigmachine.DiagnosticsConfig{
+		Dir:      dir,
+		Interval: time.Millisecond,
+		Keep:     2,
+	}))
+	defer b.Shutdown()
+	ctx := context.Background()
+	machines, err := b.Start(ctx, 1, bigmachine.Services{"Health": &healthService{Unhealthy: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := machines[0]
+	<-m.Wait(bigmachine.Running)
+	type manifest struct {
+		Machine string
+		Bundles []struct {
+			Dir    string
+			Reason string
+			Files  []string
+		}
+		Err     string
+		Failure string
+	}
+	readManifest := func() (mf manifest) {
+		paths, err := filepath.Glob(filepath.Join(dir, "*", "manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) != 1 {
+			return
+		}
+		p, err := ioutil.ReadFile(paths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(p, &mf); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	// Wait for bundles to be rotated.
+	var mf manifest
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		bundles, err := filepath.Glob(filepath.Join(dir, "*", "*", "heap.pprof"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mf = readManifest(); len(mf.Bundles) == 2 && len(bundles) == 2 {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("diagnostics not rotated: %+v, %v", mf, bundles)
+		}
+	}
+	if got, want := mf.Machine, m.Addr; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Diagnostics directories are distinguished by instance.
+	u, err := url.Parse(m.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+strings.Trim(u.Path, "/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(paths), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bundle := range mf.Bundles {
+		if got, want := bundle.Reason, "service Health: out of widgets"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if got, want := strings.Join(bundle.Files, ","), "heap.pprof,goroutine.txt,vars.json,meminfo.json"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	m.Cancel()
+	<-m.Wait(bigmachine.Stopped)
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		if mf = readManifest(); mf.Failure != "" {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("manifest not finished: %+v", mf)
+		}
+	}
+	if got, want := mf.Failure, bigmachine.FailureCanceled.String(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if mf.Err == "" {
+		t.Error("manifest does not record the machine's error")
+	}
+}